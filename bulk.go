@@ -0,0 +1,156 @@
+package storageDriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//BulkWriter queues writes and sends them together when Run is called, get one from StorageDriver.Bulk.
+//Every queued write has an index, its position in the queue, an Insert of several documents takes one index per document.
+//Writes run in order and stop at the first failure unless Unordered is called
+type BulkWriter interface {
+	Unordered() BulkWriter
+	Insert(docs ...Document) BulkWriter
+	Update(query Document, change *Update) BulkWriter
+	UpdateAll(query Document, change *Update) BulkWriter
+	Upsert(query Document, change *Update) BulkWriter
+	Remove(query Document) BulkWriter
+	RemoveAll(query Document) BulkWriter
+	Run() (*BulkResult, error)
+	RunCtx(ctx context.Context) (*BulkResult, error)
+}
+
+//BulkResult counts what a bulk changed, UpsertedIDs maps the index of an upsert that inserted a document to its _id.
+//Matched counts the documents updates found, Modified the ones they actually changed
+type BulkResult struct {
+	Inserted    int
+	Matched     int
+	Modified    int
+	Upserted    int
+	Removed     int
+	UpsertedIDs map[int]interface{}
+	Errors      []BulkItemError
+}
+
+//BulkItemError is the failure of the write at Index, Index is -1 when the driver cannot tell which write failed
+type BulkItemError struct {
+	Index int
+	Err   error
+}
+
+//BulkError is returned by Run when writes failed, the result is returned next to it with the counts of the others.
+//errors.Is matches it against the errors of the failed writes
+type BulkError struct {
+	Errors []BulkItemError
+}
+
+func (e *BulkError) Error() string {
+	var parts = make([]string, len(e.Errors))
+	for i, item := range e.Errors {
+		parts[i] = fmt.Sprintf("#%d: %v", item.Index, item.Err)
+	}
+	return fmt.Sprintf("%d bulk writes failed: %s", len(e.Errors), strings.Join(parts, "; "))
+}
+
+func (e *BulkError) Unwrap() []error {
+	var errs = make([]error, len(e.Errors))
+	for i, item := range e.Errors {
+		errs[i] = item.Err
+	}
+	return errs
+}
+
+type bulkKind int
+
+const (
+	bulkInsert bulkKind = iota
+	bulkUpdate
+	bulkUpdateAll
+	bulkUpsert
+	bulkRemove
+	bulkRemoveAll
+)
+
+type bulkOp struct {
+	kind   bulkKind
+	index  int
+	doc    Document
+	query  Document
+	change *Update
+	update Document
+}
+
+//bulk is the BulkWriter of every driver, run executes the prepared writes and fills the result
+type bulk struct {
+	ordered bool
+	ops     []bulkOp
+	run     func(ctx context.Context, ordered bool, ops []bulkOp, result *BulkResult) error
+}
+
+func (b *bulk) Unordered() BulkWriter {
+	b.ordered = false
+	return b
+}
+func (b *bulk) Insert(docs ...Document) BulkWriter {
+	for _, doc := range docs {
+		b.add(bulkOp{kind: bulkInsert, doc: doc})
+	}
+	return b
+}
+func (b *bulk) Update(query Document, change *Update) BulkWriter {
+	return b.add(bulkOp{kind: bulkUpdate, query: query, change: change})
+}
+func (b *bulk) UpdateAll(query Document, change *Update) BulkWriter {
+	return b.add(bulkOp{kind: bulkUpdateAll, query: query, change: change})
+}
+func (b *bulk) Upsert(query Document, change *Update) BulkWriter {
+	return b.add(bulkOp{kind: bulkUpsert, query: query, change: change})
+}
+func (b *bulk) Remove(query Document) BulkWriter {
+	return b.add(bulkOp{kind: bulkRemove, query: query})
+}
+func (b *bulk) RemoveAll(query Document) BulkWriter {
+	return b.add(bulkOp{kind: bulkRemoveAll, query: query})
+}
+func (b *bulk) Run() (*BulkResult, error) {
+	return b.RunCtx(context.Background())
+}
+
+//RunCtx checks the updates before anything is sent, an invalid one fails like a rejected write would
+func (b *bulk) RunCtx(ctx context.Context) (*BulkResult, error) {
+	var result = &BulkResult{UpsertedIDs: make(map[int]interface{})}
+	var ops = make([]bulkOp, 0, len(b.ops))
+	for _, op := range b.ops {
+		if op.kind == bulkUpdate || op.kind == bulkUpdateAll || op.kind == bulkUpsert {
+			var err error
+			if op.update, err = op.change.Document(); nil != err {
+				result.Errors = append(result.Errors, BulkItemError{Index: op.index, Err: err})
+				if b.ordered {
+					break
+				}
+				continue
+			}
+		}
+		ops = append(ops, op)
+	}
+	if err := b.run(ctx, b.ordered, ops, result); nil != err {
+		return result, err
+	}
+	if len(result.Errors) == 0 {
+		return result, nil
+	}
+	sort.SliceStable(result.Errors, func(i, j int) bool { return result.Errors[i].Index < result.Errors[j].Index })
+	//an ordered bulk stops at its first failure, a later invalid update never ran
+	if b.ordered {
+		result.Errors = result.Errors[:1]
+	}
+	return result, &BulkError{Errors: result.Errors}
+}
+
+func (b *bulk) add(op bulkOp) BulkWriter {
+	op.index = len(b.ops)
+	b.ops = append(b.ops, op)
+	return b
+}
@@ -0,0 +1,103 @@
+package storageDriver
+
+import (
+	"fmt"
+	"reflect"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+//ToDocument turns a struct or a map, or a pointer to one, into a Document by encoding it to bson and back.
+//The bson tags and conversions are mgo's so a value stored in the map driver reads back as it does from mongodb,
+//nested documents become Documents and arrays []interface{}. A nil map gives an empty Document
+func ToDocument(v interface{}) (Document, error) {
+	if err := checkDocumentIn(v); nil != err {
+		return nil, err
+	}
+	data, err := bson.Marshal(v)
+	if nil != err {
+		return nil, err
+	}
+	var doc = make(Document)
+	if err := bson.Unmarshal(data, &doc); nil != err {
+		return nil, err
+	}
+	return doc, nil
+}
+
+//FromDocument fills out, a pointer to a struct or a map, with doc the way mgo decodes a query result.
+//out is reset first, keys without a matching field are ignored unless the struct has an inline map
+func FromDocument(doc Document, out interface{}) error {
+	if err := checkOut(out); nil != err {
+		return err
+	}
+	rv := reflect.ValueOf(out).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	return decodeDocument(doc, out)
+}
+
+//DecodeDocuments fills out, a pointer to a slice of structs, maps or pointers to them, with docs like FromDocument
+func DecodeDocuments(docs []Document, out interface{}) error {
+	if err := checkSliceOut(out); nil != err {
+		return err
+	}
+	return decodeDocuments(docs, out)
+}
+
+//checkDocumentIn makes sure v can be stored as a whole document
+func checkDocumentIn(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct && rv.Kind() != reflect.Map {
+		return fmt.Errorf("cannot store %T as a document, a struct or a map is needed", v)
+	}
+	return nil
+}
+
+func checkOut(out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("cannot decode into %T, a pointer is needed", out)
+	}
+	return nil
+}
+
+func checkSliceOut(out interface{}) error {
+	if err := checkOut(out); nil != err {
+		return err
+	}
+	if reflect.ValueOf(out).Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("cannot decode documents into %T, a pointer to a slice is needed", out)
+	}
+	return nil
+}
+
+//decodeDocument is the single decoder of the map driver, Cursor, Iterator, FromDocument and GetInto all go through it
+func decodeDocument(doc Document, out interface{}) error {
+	data, err := bson.Marshal(doc)
+	if nil != err {
+		return err
+	}
+	return bson.Unmarshal(data, out)
+}
+
+//decodeDocuments fills the slice result points to the same way mgo's Query.All does
+func decodeDocuments(docs []Document, result interface{}) error {
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("result argument must be a slice address")
+	}
+	slicev := resultv.Elem().Slice(0, 0)
+	elemt := slicev.Type().Elem()
+	for _, doc := range docs {
+		elemp := reflect.New(elemt)
+		if err := decodeDocument(doc, elemp.Interface()); nil != err {
+			return err
+		}
+		slicev = reflect.Append(slicev, elemp.Elem())
+	}
+	resultv.Elem().Set(slicev)
+	return nil
+}
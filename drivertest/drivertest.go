@@ -0,0 +1,941 @@
+//Package drivertest is a behavioral spec every storageDriver implementation is expected to pass.
+//Call RunSuite from a test of the driver's package with a function returning a fresh Meta
+package drivertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ta3pks/storageDriver"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type Document = storageDriver.Document
+
+//RunSuite runs the whole spec against the drivers newMeta returns.
+//Every sub test selects the "drivertest" db and a table of its own, the documents it writes are removed afterwards
+func RunSuite(t *testing.T, newMeta func() storageDriver.Meta) {
+	var tests = []struct {
+		name string
+		fn   func(*testing.T, storageDriver.StorageDriver)
+	}{
+		{"Insert", testInsert},
+		{"Get", testGet},
+		{"Update", testUpdate},
+		{"UpdateMulti", testUpdateMulti},
+		{"Save", testSave},
+		{"Remove", testRemove},
+		{"RemoveMulti", testRemoveMulti},
+		{"UpdateOperators", testUpdateOperators},
+		{"FindAndModify", testFindAndModify},
+		{"Bulk", testBulk},
+		{"Structs", testStructs},
+		{"Repository", testRepository},
+		{"BulkErrors", testBulkErrors},
+		{"Operators", testOperators},
+		{"Filter", testFilter},
+		{"Paths", testPaths},
+		{"Cursor", testCursor},
+		{"CursorReuse", testCursorReuse},
+		{"Iterator", testIterator},
+		{"Errors", testErrors},
+		{"UniqueIndex", testUniqueIndex},
+		{"IDs", testIDs},
+		{"Context", testContext},
+		{"Concurrency", testConcurrency},
+		{"Lifecycle", testLifecycle},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, open(t, newMeta))
+		})
+	}
+}
+
+func open(t *testing.T, newMeta func() storageDriver.Meta) storageDriver.StorageDriver {
+	meta := newMeta()
+	if nil == meta {
+		t.Fatal("newMeta returned nil")
+	}
+	if _, err := meta.Driver(); nil == err {
+		t.Fatal("Driver is supposed to fail before DB and Table are set")
+	}
+	table := fmt.Sprintf("%s_%d", strings.Replace(t.Name(), "/", "_", -1), time.Now().UnixNano())
+	if err := meta.DB("drivertest"); nil != err {
+		t.Fatal(err)
+	}
+	if err := meta.Table(table); nil != err {
+		t.Fatal(err)
+	}
+	drv, err := meta.Driver()
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := drv.RemoveMulti(Document{}); nil != err {
+			t.Error(err)
+		}
+		if err := meta.Close(); nil != err {
+			t.Error(err)
+		}
+	})
+	return drv
+}
+
+func seed(t *testing.T, drv storageDriver.StorageDriver, n int) {
+	for i := 0; i < n; i++ {
+		if err := drv.Insert(Document{"num": i, "group": i % 5, "name": fmt.Sprintf("name%02d", i)}); nil != err {
+			t.Fatal(err)
+		}
+	}
+}
+
+func count(t *testing.T, drv storageDriver.StorageDriver, query Document) int {
+	docs, err := drv.Get(query)
+	if nil != err || nil == docs {
+		t.Fatal("Get is supposed to give a slice, empty without a match", docs, err)
+	}
+	return len(docs)
+}
+
+//asDoc normalizes the nested documents drivers hand back, mgo decodes them as bson.M
+func asDoc(v interface{}) Document {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map {
+		return nil
+	}
+	return rv.Convert(reflect.TypeOf(Document{})).Interface().(Document)
+}
+
+//asInt normalizes the integer types drivers hand back, mongo gives int or int64 while the map driver keeps what it got
+func asInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return -1
+}
+
+func testInsert(t *testing.T, drv storageDriver.StorageDriver) {
+	if err := drv.Insert(Document{"name": "one"}); nil != err {
+		t.Fatal(err)
+	}
+	if err := drv.InsertMulti([]Document{{"name": "two"}, {"name": "three"}}); nil != err {
+		t.Fatal(err)
+	}
+	if errs := drv.InsertMultiNoFail([]Document{{"name": "four"}}); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if n := count(t, drv, Document{}); n != 4 {
+		t.Fatal("expected 4 documents, got", n)
+	}
+}
+
+func testGet(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 20)
+	docs, err := drv.Get(Document{"group": 1})
+	if nil != err || len(docs) != 4 {
+		t.Fatal("Get returned", len(docs), "documents", err)
+	}
+	doc, err := drv.GetOne(Document{"num": 7})
+	if nil != err || asInt(doc["num"]) != 7 || doc["name"] != "name07" {
+		t.Fatal("GetOne returned", doc, err)
+	}
+}
+
+func testUpdate(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 5)
+	if err := drv.Update(Document{"num": 3}, Document{"name": "updated"}); nil != err {
+		t.Fatal(err)
+	}
+	doc, err := drv.GetOne(Document{"num": 3})
+	if nil != err || doc["name"] != "updated" || asInt(doc["group"]) != 3 {
+		t.Fatal("Update is supposed to only change the given fields", doc, err)
+	}
+	if n := count(t, drv, Document{"name": "updated"}); n != 1 {
+		t.Fatal("Update is supposed to change a single document, changed", n)
+	}
+}
+
+func testUpdateMulti(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 20)
+	n, err := drv.UpdateMulti(Document{"group": 2}, Document{"flag": true})
+	if nil != err || n != 4 {
+		t.Fatal("UpdateMulti updated", n, err)
+	}
+	if n := count(t, drv, Document{"flag": true}); n != 4 {
+		t.Fatal("expected 4 flagged documents, got", n)
+	}
+}
+
+func testSave(t *testing.T, drv storageDriver.StorageDriver) {
+	if err := drv.Save(Document{"key": "k"}, Document{"value": 1}); nil != err {
+		t.Fatal(err)
+	}
+	if err := drv.Save(Document{"key": "k"}, Document{"other": 2}); nil != err {
+		t.Fatal(err)
+	}
+	docs, err := drv.Get(Document{"key": "k"})
+	if nil != err || len(docs) != 1 {
+		t.Fatal("Save is supposed to insert once and update afterwards", docs, err)
+	}
+	if asInt(docs[0]["value"]) != 1 || asInt(docs[0]["other"]) != 2 {
+		t.Fatal("Save lost fields", docs[0])
+	}
+}
+
+func testUpdateOperators(t *testing.T, drv storageDriver.StorageDriver) {
+	var key = Document{"key": "u"}
+	if err := drv.Insert(Document{"key": "u", "count": 1, "tags": []interface{}{"a"}, "nums": []interface{}{1, 5, 10}, "old": 1, "gone": true, "score": 10}); nil != err {
+		t.Fatal(err)
+	}
+	change := storageDriver.NewUpdate().Inc("count", 2).Push("tags", "b", "c").Unset("gone").Rename("old", "renamed").
+		Min("score", 5).Max("high", 3).Mul("factor", 2).Set("name", "x").CurrentDate("at")
+	if err := drv.UpdateWith(key, change); nil != err {
+		t.Fatal(err)
+	}
+	doc, err := drv.GetOne(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if asInt(doc["count"]) != 3 || fmt.Sprint(doc["tags"]) != "[a b c]" || asInt(doc["renamed"]) != 1 || doc["name"] != "x" {
+		t.Fatal("$inc, $push, $rename or $set is wrong", doc)
+	}
+	if asInt(doc["score"]) != 5 || asInt(doc["high"]) != 3 || asInt(doc["factor"]) != 0 {
+		t.Fatal("$min, $max or $mul is wrong", doc)
+	}
+	if _, ok := doc["gone"]; ok {
+		t.Fatal("$unset is wrong", doc)
+	}
+	if _, ok := doc["old"]; ok {
+		t.Fatal("$rename is supposed to remove the old field", doc)
+	}
+	if at, ok := doc["at"].(time.Time); !ok || time.Since(at) > time.Minute {
+		t.Fatal("$currentDate is wrong", doc["at"])
+	}
+	if err := drv.UpdateWith(key, storageDriver.NewUpdate().AddToSet("tags", "a", "d").Pull("nums", Document{"$gte": 5})); nil != err {
+		t.Fatal(err)
+	}
+	if doc, _ = drv.GetOne(key); fmt.Sprint(doc["tags"]) != "[a b c d]" || fmt.Sprint(doc["nums"]) != "[1]" {
+		t.Fatal("$addToSet or $pull is wrong", doc)
+	}
+	if err := drv.UpdateWith(key, storageDriver.NewUpdate().Pull("tags", "b")); nil != err {
+		t.Fatal(err)
+	}
+	if doc, _ = drv.GetOne(key); fmt.Sprint(doc["tags"]) != "[a c d]" {
+		t.Fatal("$pull of a value is wrong", doc)
+	}
+
+	seed(t, drv, 10)
+	if n, err := drv.UpdateMultiWith(Document{"group": 1}, storageDriver.NewUpdate().Inc("num", 100)); nil != err || n != 2 {
+		t.Fatal("UpdateMultiWith updated", n, err)
+	}
+	if n := count(t, drv, drv.Gte(Document{"num": 100})); n != 2 {
+		t.Fatal("UpdateMultiWith is wrong", n)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := drv.SaveWith(Document{"key": "new"}, storageDriver.NewUpdate().Inc("v", 1)); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if docs, err := drv.Get(Document{"key": "new"}); nil != err || len(docs) != 1 || asInt(docs[0]["v"]) != 2 {
+		t.Fatal("SaveWith is supposed to insert once and update afterwards", docs, err)
+	}
+	if err := drv.UpdateWith(Document{"key": "missing"}, storageDriver.NewUpdate().Set("a", 1)); !errors.Is(err, storageDriver.ErrNotFound) {
+		t.Fatal("UpdateWith is supposed to give ErrNotFound", err)
+	}
+	if err := drv.UpdateWith(key, storageDriver.NewUpdate().Set("a", 1).Inc("a", 1)); nil == err {
+		t.Fatal("conflicting operators are supposed to fail")
+	}
+}
+
+func testFindAndModify(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 10)
+	old, err := drv.FindAndUpdate(Document{"group": 2}, storageDriver.NewUpdate().Set("picked", true), storageDriver.FindAndUpdateOptions{Sort: []string{"-num"}})
+	if nil != err || asInt(old["num"]) != 7 || nil != old["picked"] {
+		t.Fatal("FindAndUpdate is supposed to return the document before the change", old, err)
+	}
+	updated, err := drv.FindAndUpdate(Document{"num": 7}, storageDriver.NewUpdate().Inc("num", 100), storageDriver.FindAndUpdateOptions{ReturnNew: true, Fields: []string{"num", "picked"}})
+	if nil != err || asInt(updated["num"]) != 107 || updated["picked"] != true {
+		t.Fatal("FindAndUpdate is supposed to return the document after the change", updated, err)
+	}
+	if _, ok := updated["name"]; ok {
+		t.Fatal("Fields is supposed to restrict the returned fields", updated)
+	}
+	if _, err := drv.FindAndUpdate(Document{"num": 1000}, storageDriver.NewUpdate().Set("a", 1), storageDriver.FindAndUpdateOptions{}); !errors.Is(err, storageDriver.ErrNotFound) {
+		t.Fatal("FindAndUpdate is supposed to give ErrNotFound", err)
+	}
+	doc, err := drv.FindAndUpdate(Document{"num": 1000}, storageDriver.NewUpdate().Set("a", 1), storageDriver.FindAndUpdateOptions{Upsert: true})
+	if nil != err || nil != doc {
+		t.Fatal("an upsert without ReturnNew is supposed to return nil", doc, err)
+	}
+	doc, err = drv.FindAndUpdate(Document{"num": 2000}, storageDriver.NewUpdate().Set("a", 2), storageDriver.FindAndUpdateOptions{Upsert: true, ReturnNew: true})
+	if nil != err || asInt(doc["num"]) != 2000 || asInt(doc["a"]) != 2 {
+		t.Fatal("an upsert with ReturnNew is supposed to return the new document", doc, err)
+	}
+	removed, err := drv.FindAndRemove(Document{"num": 1000})
+	if nil != err || asInt(removed["a"]) != 1 {
+		t.Fatal("FindAndRemove is supposed to return the removed document", removed, err)
+	}
+	if _, err := drv.FindAndRemove(Document{"num": 1000}); !errors.Is(err, storageDriver.ErrNotFound) {
+		t.Fatal("FindAndRemove is supposed to give ErrNotFound", err)
+	}
+	if n := count(t, drv, Document{}); n != 11 {
+		t.Fatal("expected 11 documents, got", n)
+	}
+}
+
+func testRemove(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 10)
+	if err := drv.Remove(Document{"group": 1}); nil != err {
+		t.Fatal(err)
+	}
+	if n := count(t, drv, Document{"group": 1}); n != 1 {
+		t.Fatal("Remove is supposed to remove a single document, left", n)
+	}
+	if n := count(t, drv, Document{}); n != 9 {
+		t.Fatal("expected 9 documents, got", n)
+	}
+}
+
+func testRemoveMulti(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 20)
+	n, err := drv.RemoveMulti(Document{"group": 3})
+	if nil != err || n != 4 {
+		t.Fatal("RemoveMulti removed", n, err)
+	}
+	if n := count(t, drv, Document{"group": 3}); n != 0 {
+		t.Fatal("RemoveMulti left", n, "documents")
+	}
+	if n, err := drv.RemoveMulti(Document{"group": 3}); nil != err || n != 0 {
+		t.Fatal("RemoveMulti without a match is supposed to give 0 and no error", n, err)
+	}
+	if n, err := drv.RemoveMulti(drv.Gte(Document{"num": 10})); nil != err || n != 8 {
+		t.Fatal("RemoveMulti removed", n, err)
+	}
+	if n := count(t, drv, Document{}); n != 8 {
+		t.Fatal("expected 8 documents, got", n)
+	}
+}
+
+func testBulk(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 10)
+	result, err := drv.Bulk().
+		Insert(Document{"num": 10, "group": 0}, Document{"num": 11, "group": 1}).
+		Update(Document{"group": 1}, storageDriver.NewUpdate().Set("flag", true)).
+		UpdateAll(Document{"group": 2}, storageDriver.NewUpdate().Set("flag", true)).
+		Upsert(Document{"num": 100}, storageDriver.NewUpdate().Set("group", 9)).
+		Upsert(Document{"num": 0}, storageDriver.NewUpdate().Set("group", 0)).
+		Remove(Document{"group": 3}).
+		RemoveAll(Document{"group": 4}).
+		Run()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if result.Inserted != 2 || result.Matched != 4 || result.Modified != 3 || result.Upserted != 1 || result.Removed != 3 {
+		t.Fatalf("unexpected counts %+v", result)
+	}
+	if _, ok := result.UpsertedIDs[4]; !ok || len(result.UpsertedIDs) != 1 {
+		t.Fatal("expected the upsert at index 4 in UpsertedIDs, got", result.UpsertedIDs)
+	}
+	if n := count(t, drv, Document{}); n != 10 {
+		t.Fatal("expected 10 documents, got", n)
+	}
+	if n := count(t, drv, Document{"flag": true}); n != 3 {
+		t.Fatal("expected 3 updated documents, got", n)
+	}
+	if n := count(t, drv, Document{"num": 100, "group": 9}); n != 1 {
+		t.Fatal("the upsert did not insert its document")
+	}
+	if result, err := drv.Bulk().Run(); nil != err || result.Inserted != 0 {
+		t.Fatal("an empty bulk is supposed to do nothing", result, err)
+	}
+}
+
+func testBulkErrors(t *testing.T, drv storageDriver.StorageDriver) {
+	meta, ok := drv.(storageDriver.Meta)
+	if !ok {
+		t.Skip("the driver does not expose Meta")
+	}
+	if err := meta.EnsureUniqueIndex("email"); nil != err {
+		t.Fatal(err)
+	}
+	var bulkErr *storageDriver.BulkError
+	result, err := drv.Bulk().Insert(Document{"email": "a"}, Document{"email": "a"}, Document{"email": "b"}).Run()
+	if !errors.As(err, &bulkErr) || !errors.Is(err, storageDriver.ErrDuplicateKey) {
+		t.Fatal("a duplicate is supposed to give a BulkError matching ErrDuplicateKey", err)
+	}
+	if len(bulkErr.Errors) != 1 || bulkErr.Errors[0].Index != 1 || result.Inserted != 1 {
+		t.Fatalf("an ordered bulk is supposed to stop at the duplicate %+v %+v", bulkErr.Errors, result)
+	}
+	if n := count(t, drv, Document{"email": "b"}); n != 0 {
+		t.Fatal("an ordered bulk kept going after a failure")
+	}
+	result, err = drv.Bulk().Unordered().Insert(Document{"email": "c"}, Document{"email": "a"}, Document{"email": "d"}).Run()
+	if !errors.As(err, &bulkErr) || len(bulkErr.Errors) != 1 || bulkErr.Errors[0].Index != 1 || result.Inserted != 2 {
+		t.Fatalf("an unordered bulk is supposed to skip the duplicate only %v %+v", err, result)
+	}
+	if n := count(t, drv, Document{"email": "d"}); n != 1 {
+		t.Fatal("an unordered bulk stopped at a failure")
+	}
+	result, err = drv.Bulk().
+		Insert(Document{"email": "e"}).
+		Update(Document{"email": "e"}, storageDriver.NewUpdate()).
+		Insert(Document{"email": "f"}).
+		Run()
+	if !errors.As(err, &bulkErr) || len(bulkErr.Errors) != 1 || bulkErr.Errors[0].Index != 1 || result.Inserted != 1 {
+		t.Fatalf("an invalid update is supposed to fail like a rejected write %v %+v", err, result)
+	}
+	if n := count(t, drv, Document{"email": "f"}); n != 0 {
+		t.Fatal("an ordered bulk kept going after an invalid update")
+	}
+}
+
+type address struct {
+	City string `bson:"city"`
+}
+type person struct {
+	ID      string            `bson:"_id,omitempty"`
+	Name    string            `bson:"name"`
+	Age     int               `bson:"age,omitempty"`
+	Address address           `bson:",inline"`
+	Tags    []string          `bson:"tags,omitempty"`
+	Extra   map[string]string `bson:",inline"`
+}
+
+func testStructs(t *testing.T, drv storageDriver.StorageDriver) {
+	ali := person{ID: "p1", Name: "Ali", Age: 30, Address: address{City: "Izmir"}, Tags: []string{"a"}, Extra: map[string]string{"nick": "al"}}
+	if err := drv.InsertStruct(ali); nil != err {
+		t.Fatal(err)
+	}
+	if err := drv.InsertStruct(&person{ID: "p2", Name: "Veli"}); nil != err {
+		t.Fatal(err)
+	}
+	doc, err := drv.GetOne(Document{"_id": "p1"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if doc["name"] != "Ali" || doc["city"] != "Izmir" || doc["nick"] != "al" || asInt(doc["age"]) != 30 {
+		t.Fatal("the tags are not applied", doc)
+	}
+	if doc, _ := drv.GetOne(Document{"_id": "p2"}); nil != doc["age"] || nil != doc["tags"] {
+		t.Fatal("omitempty fields are stored", doc)
+	}
+	var got person
+	if err := drv.GetOneInto(Document{"city": "Izmir"}, &got); nil != err {
+		t.Fatal(err)
+	}
+	if got.ID != "p1" || got.Name != "Ali" || got.Age != 30 || got.Address.City != "Izmir" || len(got.Tags) != 1 || got.Extra["nick"] != "al" {
+		t.Fatalf("GetOneInto gave %+v", got)
+	}
+	if err := drv.GetOneInto(Document{"_id": "none"}, &got); !errors.Is(err, storageDriver.ErrNotFound) {
+		t.Fatal("GetOneInto without a match is supposed to give ErrNotFound", err)
+	}
+	if err := drv.UpdateStruct(Document{"_id": "p2"}, person{Name: "Veli", Age: 40}); nil != err {
+		t.Fatal(err)
+	}
+	if err := drv.SaveStruct(Document{"_id": "p3"}, person{Name: "Deniz"}); nil != err {
+		t.Fatal(err)
+	}
+	var people []person
+	if err := drv.GetInto(Document{}, &people); nil != err {
+		t.Fatal(err)
+	}
+	if len(people) != 3 {
+		t.Fatal("expected 3 people, got", people)
+	}
+	var ages = make(map[string]int)
+	for _, p := range people {
+		ages[p.ID] = p.Age
+	}
+	if ages["p1"] != 30 || ages["p2"] != 40 || ages["p3"] != 0 {
+		t.Fatal("unexpected ages", ages)
+	}
+	if err := drv.GetInto(Document{}, &got); nil == err {
+		t.Fatal("GetInto is supposed to need a pointer to a slice")
+	}
+	if err := drv.InsertStruct(42); nil == err {
+		t.Fatal("InsertStruct is supposed to need a struct")
+	}
+}
+
+func testRepository(t *testing.T, drv storageDriver.StorageDriver) {
+	repo := storageDriver.NewRepository[person](drv)
+	for i, name := range []string{"Ali", "Veli", "Deniz"} {
+		if err := repo.Insert(person{ID: fmt.Sprint("p", i), Name: name, Age: 20 + i}); nil != err {
+			t.Fatal(err)
+		}
+	}
+	veli, err := repo.Get("p1")
+	if nil != err || veli.Name != "Veli" {
+		t.Fatal("Get gave", veli, err)
+	}
+	if _, err := repo.Get("none"); !errors.Is(err, storageDriver.ErrNotFound) {
+		t.Fatal("Get without a match is supposed to give ErrNotFound", err)
+	}
+	veli.Age = 40
+	if err := repo.Update(veli); nil != err {
+		t.Fatal(err)
+	}
+	if got, err := repo.FindOne(storageDriver.Eq("name", "Veli")); nil != err || got.Age != 40 {
+		t.Fatal("Update is not applied", got, err)
+	}
+	if err := repo.Save(person{ID: "p3", Name: "Ece", Age: 30}); nil != err {
+		t.Fatal(err)
+	}
+	older, err := repo.Find(storageDriver.Gte("age", 22))
+	if nil != err || len(older) != 3 {
+		t.Fatal("Find gave", older, err)
+	}
+	if none, err := repo.Find(storageDriver.Gt("age", 100)); nil != err || len(none) != 0 {
+		t.Fatal("Find without a match is supposed to give no values and no error", none, err)
+	}
+	if err := repo.Update(person{Name: "nobody"}); !errors.Is(err, storageDriver.ErrNoID) {
+		t.Fatal("a value without an id is supposed to give ErrNoID", err)
+	}
+	if err := repo.Delete(veli); nil != err {
+		t.Fatal(err)
+	}
+	var names []string
+	if err := repo.ForEach(storageDriver.Gte("age", 0), func(p person) error {
+		names = append(names, p.Name)
+		return nil
+	}); nil != err || len(names) != 3 {
+		t.Fatal("ForEach gave", names, err)
+	}
+	it := repo.Iter(storageDriver.Eq("name", "Ece"))
+	var p person
+	if !it.Next(&p) || p.ID != "p3" || it.Next(&p) {
+		t.Fatal("Iter gave", p, it.Err())
+	}
+	if err := it.Close(); nil != err {
+		t.Fatal(err)
+	}
+
+	byName := storageDriver.NewRepository(drv, storageDriver.RepositoryID("name", func(p *person) interface{} { return p.Name }))
+	ece, err := byName.Get("Ece")
+	if nil != err || ece.Age != 30 {
+		t.Fatal("Get by a custom id gave", ece, err)
+	}
+	ece.Age = 31
+	if err := byName.Update(ece); nil != err {
+		t.Fatal(err)
+	}
+	if got, _ := repo.Get("p3"); got.Age != 31 {
+		t.Fatal("Update by a custom id is not applied", got)
+	}
+}
+
+func testOperators(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 20)
+	var cases = []struct {
+		name  string
+		query Document
+		count int
+	}{
+		{"Gt", drv.Gt(Document{"num": 15}), 4},
+		{"Gte", drv.Gte(Document{"num": 15}), 5},
+		{"Lt", drv.Lt(Document{"num": 3}), 3},
+		{"Lte", drv.Lte(Document{"num": 3}), 4},
+		{"In", drv.In("num", []interface{}{1, 2, 100}), 2},
+		{"Between", drv.Between("num", [2]interface{}{5, 9}), 5},
+		{"Not", drv.Not(Document{"group": 0}), 16},
+		{"Regex", drv.Regex("name", "^name1"), 10},
+	}
+	for _, c := range cases {
+		if n := count(t, drv, c.query); n != c.count {
+			t.Error(c.name, "matched", n, "documents instead of", c.count)
+		}
+	}
+}
+
+func testFilter(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 20)
+	var cases = []struct {
+		name   string
+		filter storageDriver.Filter
+		count  int
+	}{
+		{"Eq", storageDriver.Eq("num", 4), 1},
+		{"And", storageDriver.And(storageDriver.Gte("num", 10), storageDriver.Eq("group", 0)), 2},
+		{"Or", storageDriver.Or(storageDriver.Eq("num", 1), storageDriver.Eq("num", 2)), 2},
+		{"Not", storageDriver.Not(storageDriver.Lt("num", 18)), 2},
+		{"Exists", storageDriver.Exists("group"), 20},
+		{"Missing", storageDriver.Missing("group"), 0},
+		{"Where", storageDriver.Where(Document{"group": 4}), 4},
+	}
+	for _, c := range cases {
+		docs, err := drv.Find(c.filter)
+		if nil != err || nil == docs {
+			t.Fatal(c.name, "is supposed to give a slice, empty without a match", docs, err)
+		}
+		if len(docs) != c.count {
+			t.Error(c.name, "matched", len(docs), "documents instead of", c.count)
+		}
+	}
+	if doc, err := drv.FindOne(storageDriver.Eq("name", "name03")); nil != err || asInt(doc["num"]) != 3 {
+		t.Fatal("FindOne returned", doc, err)
+	}
+}
+
+func testPaths(t *testing.T, drv storageDriver.StorageDriver) {
+	for _, doc := range []Document{
+		{"name": "a", "address": Document{"city": "Izmir", "zip": "35"}, "items": []interface{}{Document{"sku": "x", "qty": 1}, Document{"sku": "y", "qty": 2}}},
+		{"name": "b", "address": Document{"city": "Ankara"}, "items": []interface{}{Document{"sku": "y", "qty": 5}}},
+		{"name": "c"},
+	} {
+		if err := drv.Insert(doc); nil != err {
+			t.Fatal(err)
+		}
+	}
+	var cases = []struct {
+		name  string
+		query Document
+		want  int
+	}{
+		{"nested", Document{"address.city": "Izmir"}, 1},
+		{"fan out", Document{"items.sku": "y"}, 2},
+		{"fan out operator", Document{"items.qty": Document{"$gt": 4}}, 1},
+		{"index", Document{"items.0.sku": "x"}, 1},
+		{"index out of range", Document{"items.1.sku": "y"}, 1},
+		{"missing", Document{"address.zip": Document{"$exists": false}}, 2},
+		{"ne over fan out", Document{"items.sku": Document{"$ne": "x"}}, 2},
+		{"elemMatch", Document{"items": Document{"$elemMatch": Document{"sku": "y", "qty": 2}}}, 1},
+	}
+	for _, c := range cases {
+		if n := count(t, drv, c.query); n != c.want {
+			t.Errorf("%s: expected %d documents, got %d", c.name, c.want, n)
+		}
+	}
+	if docs, err := drv.Find(storageDriver.Not(storageDriver.Eq("items.sku", "y"))); nil != err || len(docs) != 1 || docs[0]["name"] != "c" {
+		t.Fatal("a Filter on a path gave", docs, err)
+	}
+	var sorted []Document
+	if err := drv.Cursor().Sort("address.city").All(&sorted); nil != err || len(sorted) != 3 || sorted[0]["name"] != "c" || sorted[1]["name"] != "b" {
+		t.Fatal("sorting on a path gave", sorted, err)
+	}
+	var projected Document
+	if err := drv.Cursor().And(Document{"name": "a"}).Select("address.city", "items.sku").One(&projected); nil != err {
+		t.Fatal(err)
+	}
+	items, _ := projected["items"].([]interface{})
+	if _, ok := projected["name"]; ok || asDoc(projected["address"])["city"] != "Izmir" || nil != asDoc(projected["address"])["zip"] ||
+		len(items) != 2 || asDoc(items[1])["sku"] != "y" || nil != asDoc(items[1])["qty"] {
+		t.Fatal("projecting paths gave", projected)
+	}
+
+	if err := drv.UpdateWith(Document{"name": "a"}, storageDriver.NewUpdate().Set("items.0.qty", 3).Inc("address.visits", 1)); nil != err {
+		t.Fatal(err)
+	}
+	a, _ := drv.GetOne(Document{"name": "a"})
+	items, _ = a["items"].([]interface{})
+	if len(items) != 2 || asInt(asDoc(items[0])["qty"]) != 3 || asInt(asDoc(a["address"])["visits"]) != 1 || asDoc(a["address"])["city"] != "Izmir" {
+		t.Fatal("updating paths gave", a)
+	}
+	if err := drv.Update(Document{"name": "c"}, Document{"address.city": "Bursa"}); nil != err {
+		t.Fatal(err)
+	}
+	if n := count(t, drv, Document{"address.city": "Bursa", "name": "c"}); n != 1 {
+		t.Fatal("Update is supposed to set paths")
+	}
+	if err := drv.UpdateWith(Document{"name": "b"}, storageDriver.NewUpdate().Unset("address.city")); nil != err {
+		t.Fatal(err)
+	}
+	if b, _ := drv.GetOne(Document{"name": "b"}); nil == b["address"] || len(asDoc(b["address"])) != 0 {
+		t.Fatal("Unset of a path is supposed to keep the parent", b)
+	}
+	if err := drv.UpdateWith(Document{"name": "a"}, storageDriver.NewUpdate().Set("address.city", "Bursa").Set("name.first", "x")); nil == err {
+		t.Fatal("setting a path through a string is supposed to fail")
+	}
+	if n := count(t, drv, Document{"address.city": "Izmir"}); n != 1 {
+		t.Fatal("a failed update is not supposed to change anything")
+	}
+}
+
+func testCursor(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 20)
+	var docs []Document
+	err := drv.Cursor().And(drv.Gte(Document{"num": 5})).Sort("-group", "num").Skip(1).Limit(3).Select("num", "group").All(&docs)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(docs) != 3 || asInt(docs[0]["num"]) != 14 || asInt(docs[2]["num"]) != 8 {
+		t.Fatal("sort, skip or limit is wrong", docs)
+	}
+	if _, ok := docs[0]["name"]; ok {
+		t.Fatal("Select is supposed to drop other fields", docs[0])
+	}
+	if _, ok := docs[0]["_id"]; ok {
+		t.Fatal("Select is supposed to drop the _id", docs[0])
+	}
+	var one Document
+	if err := drv.Cursor().Or([]interface{}{Document{"num": 3}, Document{"num": 4}}).Sort("-num").One(&one); nil != err || asInt(one["num"]) != 4 {
+		t.Fatal("Or or One is wrong", one, err)
+	}
+	var n int
+	if err := drv.Cursor().Where(storageDriver.Lt("num", 10)).Count(&n); nil != err || n != 10 {
+		t.Fatal("Count is wrong", n, err)
+	}
+	var groups []int
+	if err := drv.Cursor().Distinct("group", &groups); nil != err || len(groups) != 5 {
+		t.Fatal("Distinct is wrong", groups, err)
+	}
+}
+
+func testCursorReuse(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 20)
+	base := drv.Cursor().And(drv.Gte(Document{"num": 10}))
+	or := base.Or([]interface{}{Document{"num": 10}, Document{"num": 11}})
+	sorted := base.Sort("-num").Limit(2)
+	var one Document
+	var n int
+	if err := or.One(&one); nil != err {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := or.Count(&n); nil != err || n != 2 {
+			t.Fatal("running a cursor is not supposed to change it", n, err)
+		}
+	}
+	var docs []Document
+	if err := sorted.All(&docs); nil != err || len(docs) != 2 || asInt(docs[0]["num"]) != 19 {
+		t.Fatal("sort or limit is wrong", docs, err)
+	}
+	if err := base.Count(&n); nil != err || n != 10 {
+		t.Fatal("deriving cursors is not supposed to change the base cursor", n, err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 5; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			var n int
+			if err := base.And(Document{"group": g}).Count(&n); nil != err || n != 2 {
+				t.Error("a shared cursor gave", n, "documents for group", g, err)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func testIterator(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 20)
+	it := drv.Cursor().And(drv.Gte(Document{"num": 5})).Sort("num").Batch(3).Prefetch(0.5).Iter()
+	var doc Document
+	var next = 5
+	for it.Next(&doc) {
+		if asInt(doc["num"]) != next {
+			t.Fatal("expected", next, "got", doc)
+		}
+		next++
+	}
+	if nil != it.Err() || next != 20 {
+		t.Fatal("the iterator stopped at", next, it.Err())
+	}
+	if err := it.Close(); nil != err {
+		t.Fatal(err)
+	}
+
+	it = drv.Cursor().Iter()
+	if !it.Next(&doc) {
+		t.Fatal("no documents", it.Err())
+	}
+	if err := it.Close(); nil != err || it.Next(&doc) {
+		t.Fatal("Next is not supposed to go on after Close", err)
+	}
+
+	var seen []Document
+	err := drv.Cursor().Sort("num").ForEach(func(doc Document) error {
+		seen = append(seen, doc)
+		if len(seen) == 3 {
+			return storageDriver.ErrStopIteration
+		}
+		return nil
+	})
+	if nil != err || len(seen) != 3 || asInt(seen[0]["num"]) != 0 || asInt(seen[2]["num"]) != 2 {
+		t.Fatal("ForEach is supposed to stop on ErrStopIteration", seen, err)
+	}
+	var failure = errors.New("failure")
+	if err := drv.Cursor().ForEach(func(Document) error { return failure }); err != failure {
+		t.Fatal("ForEach is supposed to return the error of the callback", err)
+	}
+	var n int
+	if err := drv.Cursor().ForEach(func(Document) error { n++; return nil }); nil != err || n != 20 {
+		t.Fatal("ForEach visited", n, "documents", err)
+	}
+}
+
+func testErrors(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 3)
+	if _, err := drv.GetOne(Document{"num": 100}); !errors.Is(err, storageDriver.ErrNotFound) {
+		t.Error("GetOne is supposed to give ErrNotFound", err)
+	}
+	if docs, err := drv.Get(Document{"num": 100}); nil != err || nil == docs || len(docs) != 0 {
+		t.Error("Get without a match is supposed to give an empty slice", docs, err)
+	}
+	if docs, err := drv.Find(storageDriver.Eq("num", 100)); nil != err || nil == docs || len(docs) != 0 {
+		t.Error("Find without a match is supposed to give an empty slice", docs, err)
+	}
+	var none []Document
+	if err := drv.GetInto(Document{"num": 100}, &none); nil != err || len(none) != 0 {
+		t.Error("GetInto without a match is supposed to give an empty slice", none, err)
+	}
+	if err := drv.Update(Document{"num": 100}, Document{"x": 1}); !errors.Is(err, storageDriver.ErrNotFound) {
+		t.Error("Update is supposed to give ErrNotFound", err)
+	}
+	if err := drv.Remove(Document{"num": 100}); !errors.Is(err, storageDriver.ErrNotFound) {
+		t.Error("Remove is supposed to give ErrNotFound", err)
+	}
+	var one Document
+	if err := drv.Cursor().And(Document{"num": 100}).One(&one); !errors.Is(err, storageDriver.ErrNotFound) {
+		t.Error("Cursor One is supposed to give ErrNotFound", err)
+	}
+	if _, err := drv.Custom(nil); !errors.Is(err, storageDriver.ErrNotImplemented) {
+		t.Error("Custom is supposed to give ErrNotImplemented", err)
+	}
+	var unknown = Document{"num": Document{"$nosuch": 1}}
+	if _, err := drv.Get(unknown); nil == err {
+		t.Error("Get is supposed to reject an unknown operator")
+	}
+	if n, err := drv.RemoveMulti(unknown); nil == err || n != 0 {
+		t.Error("RemoveMulti is supposed to reject an unknown operator", n, err)
+	}
+	var all []Document
+	if err := drv.Cursor().And(unknown).All(&all); nil == err {
+		t.Error("a cursor is supposed to reject an unknown operator")
+	}
+}
+
+func testUniqueIndex(t *testing.T, drv storageDriver.StorageDriver) {
+	meta, ok := drv.(storageDriver.Meta)
+	if !ok {
+		t.Skip("the driver does not expose Meta")
+	}
+	if err := meta.EnsureUniqueIndex("email"); nil != err {
+		t.Fatal(err)
+	}
+	if err := drv.Insert(Document{"email": "a@b.c"}); nil != err {
+		t.Fatal(err)
+	}
+	if err := drv.Insert(Document{"email": "a@b.c"}); !errors.Is(err, storageDriver.ErrDuplicateKey) {
+		t.Fatal("a duplicate is supposed to give ErrDuplicateKey", err)
+	}
+	if n := count(t, drv, Document{"email": "a@b.c"}); n != 1 {
+		t.Fatal("the duplicate was stored")
+	}
+}
+
+func testIDs(t *testing.T, drv storageDriver.StorageDriver) {
+	id, err := drv.InsertWithID(Document{"name": "a"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, ok := id.(bson.ObjectId); !ok {
+		t.Fatalf("the generated _id is supposed to be an ObjectId, got %T", id)
+	}
+	if doc, err := drv.GetOne(Document{"_id": id}); nil != err || doc["name"] != "a" {
+		t.Fatal("cannot get the document by its generated _id", doc, err)
+	}
+	if id, err := drv.InsertWithID(Document{"_id": "b", "name": "b"}); nil != err || id != "b" {
+		t.Fatal("an existing _id is supposed to be kept", id, err)
+	}
+	if err := drv.Insert(Document{"_id": id}); !errors.Is(err, storageDriver.ErrDuplicateKey) {
+		t.Fatal("a duplicate _id is supposed to give ErrDuplicateKey", err)
+	}
+	if err := drv.Update(Document{"_id": id}, Document{"_id": "other"}); !errors.Is(err, storageDriver.ErrImmutableID) {
+		t.Fatal("changing the _id is supposed to give ErrImmutableID", err)
+	}
+	if err := drv.UpdateWith(Document{"_id": "b"}, storageDriver.NewUpdate().Set("_id", "other")); !errors.Is(err, storageDriver.ErrImmutableID) {
+		t.Fatal("changing the _id with an operator is supposed to give ErrImmutableID", err)
+	}
+	if err := drv.Update(Document{"_id": id}, Document{"_id": id, "name": "c"}); nil != err {
+		t.Fatal("setting the same _id is supposed to work", err)
+	}
+	if n := count(t, drv, Document{}); n != 2 {
+		t.Fatal("expected 2 documents, got", n)
+	}
+}
+
+func testContext(t *testing.T, drv storageDriver.StorageDriver) {
+	seed(t, drv, 5)
+	ctx, cancel := context.WithCancel(context.Background())
+	if docs, err := drv.GetCtx(ctx, Document{}); nil != err || len(docs) != 5 {
+		t.Fatal("GetCtx returned", len(docs), err)
+	}
+	cancel()
+	if _, err := drv.GetCtx(ctx, Document{}); !errors.Is(err, context.Canceled) {
+		t.Error("GetCtx is supposed to give context.Canceled", err)
+	}
+	if err := drv.InsertCtx(ctx, Document{"num": 5}); !errors.Is(err, context.Canceled) {
+		t.Error("InsertCtx is supposed to give context.Canceled", err)
+	}
+	if n := count(t, drv, Document{}); n != 5 {
+		t.Fatal("a cancelled insert was stored")
+	}
+}
+
+func testConcurrency(t *testing.T, drv storageDriver.StorageDriver) {
+	const workers, perWorker = 8, 25
+	if err := drv.Insert(Document{"counter": true, "n": 0}); nil != err {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				if err := drv.Insert(Document{"worker": w, "i": i}); nil != err {
+					t.Error(err)
+					return
+				}
+				if _, err := drv.GetOne(Document{"worker": w, "i": i}); nil != err {
+					t.Error(err)
+					return
+				}
+				if err := drv.UpdateWith(Document{"counter": true}, storageDriver.NewUpdate().Inc("n", 1)); nil != err {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if n := count(t, drv, Document{"worker": Document{"$exists": true}}); n != workers*perWorker {
+		t.Fatal("expected", workers*perWorker, "documents, got", n)
+	}
+	if counter, err := drv.GetOne(Document{"counter": true}); nil != err || asInt(counter["n"]) != workers*perWorker {
+		t.Fatal("concurrent increments are supposed to be atomic", counter, err)
+	}
+}
+
+func testLifecycle(t *testing.T, drv storageDriver.StorageDriver) {
+	meta, ok := drv.(storageDriver.Meta)
+	if !ok {
+		t.Skip("the driver does not expose Meta")
+	}
+	if err := meta.Ping(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	if report := meta.Health(); !report.Healthy || nil != report.Err || report.Driver == "" {
+		t.Fatal("unexpected health report", report)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := meta.Ping(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatal("Ping is supposed to give context.Canceled", err)
+	}
+}
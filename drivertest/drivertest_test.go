@@ -0,0 +1,38 @@
+package drivertest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ta3pks/storageDriver"
+)
+
+func TestMapDriver(t *testing.T) {
+	RunSuite(t, func() storageDriver.Meta { return storageDriver.NewMapDriver() })
+}
+
+func TestPersistentMapDriver(t *testing.T) {
+	dir := t.TempDir()
+	RunSuite(t, func() storageDriver.Meta {
+		m := storageDriver.NewMapDriver(storageDriver.WithPersistence(dir), storageDriver.SnapshotInterval(0))
+		if err := m.Ping(context.Background()); nil != err {
+			t.Fatal(err)
+		}
+		return m
+	})
+}
+
+func TestMongoDriver(t *testing.T) {
+	probe, err := storageDriver.NewMongoDriver("mongodb://localhost:27017")
+	if nil != err {
+		t.Skip("no mongodb on localhost:27017: ", err)
+	}
+	defer probe.Close()
+	RunSuite(t, func() storageDriver.Meta {
+		m, err := storageDriver.NewMongoDriver("mongodb://localhost:27017")
+		if nil != err {
+			t.Fatal(err)
+		}
+		return m
+	})
+}
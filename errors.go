@@ -0,0 +1,57 @@
+package storageDriver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//Errors shared by all drivers, compare against them with errors.Is
+var (
+	ErrNotFound       = errors.New("no documents found")
+	ErrDuplicateKey   = errors.New("duplicate key")
+	ErrNotImplemented = errors.New("not implemented")
+	ErrNoCollection   = errors.New("database or collection is not set")
+	ErrClosed         = errors.New("driver is closed")
+	//ErrImmutableID is returned by an update which would change the _id of a document
+	ErrImmutableID = errors.New("the _id of a document cannot be changed")
+	//ErrNoID is returned by a Repository for a value it cannot find the id of
+	ErrNoID = errors.New("value has no id")
+	//ErrStopIteration ends ForEach early without an error when the callback returns it
+	ErrStopIteration = errors.New("stop iteration")
+)
+
+//DriverError wraps a native driver error keeping it as the cause.
+//errors.Is matches it against Kind, which is one of the Err* values or nil when the error has no portable meaning
+type DriverError struct {
+	Driver string
+	Op     string
+	Kind   error
+	Err    error
+}
+
+func (e *DriverError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Driver, e.Op, e.Err)
+}
+
+func (e *DriverError) Unwrap() error { return e.Err }
+
+func (e *DriverError) Is(target error) bool {
+	return nil != e.Kind && target == e.Kind
+}
+
+//DuplicateKeyError is returned when a write would break a unique index, it matches ErrDuplicateKey
+type DuplicateKeyError struct {
+	Index []string
+	Key   []interface{}
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate key %v for the unique index on %s", e.Key, strings.Join(e.Index, ", "))
+}
+
+func (e *DuplicateKeyError) Is(target error) bool { return target == ErrDuplicateKey }
+
+func isDuplicateKey(err error) bool {
+	return errors.Is(err, ErrDuplicateKey)
+}
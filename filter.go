@@ -0,0 +1,230 @@
+package storageDriver
+
+import "fmt"
+
+//Filter is a driver agnostic query tree. Every driver compiles it into its own native query form.
+//Build it with Eq, Gt, In, And, Or, Not, Exists, All, Size, ElemMatch ... or wrap an existing Document query with Where
+type Filter interface {
+	filter()
+}
+
+//Operator is the name of a filter operator, it reuses the mongo spelling so drivers can share it
+type Operator string
+
+const (
+	OpEq        Operator = "$eq"
+	OpNe        Operator = "$ne"
+	OpGt        Operator = "$gt"
+	OpGte       Operator = "$gte"
+	OpLt        Operator = "$lt"
+	OpLte       Operator = "$lte"
+	OpIn        Operator = "$in"
+	OpNin       Operator = "$nin"
+	OpRegex     Operator = "$regex"
+	OpAnd       Operator = "$and"
+	OpOr        Operator = "$or"
+	OpNor       Operator = "$nor"
+	OpAll       Operator = "$all"
+	OpSize      Operator = "$size"
+	OpElemMatch Operator = "$elemMatch"
+)
+
+type (
+	//Comparison compares the value of Field against Value.
+	//Inside ElemMatch an empty Field refers to the array element itself
+	Comparison struct {
+		Field string
+		Op    Operator
+		Value interface{}
+	}
+	//Logical combines Filters with OpAnd, OpOr or OpNor
+	Logical struct {
+		Op      Operator
+		Filters []Filter
+	}
+	//Negation matches documents not matching Filter
+	Negation struct {
+		Filter Filter
+	}
+	//Existence checks whether Field is present on the document
+	Existence struct {
+		Field  string
+		Exists bool
+	}
+	//ArrayPredicate checks an array field with OpAll ([]interface{}), OpSize (int) or OpElemMatch (Filter)
+	ArrayPredicate struct {
+		Field string
+		Op    Operator
+		Value interface{}
+	}
+	//DocumentFilter adapts a mongo shaped Document query to a Filter
+	DocumentFilter struct {
+		Query Document
+	}
+)
+
+func (Comparison) filter()     {}
+func (Logical) filter()        {}
+func (Negation) filter()       {}
+func (Existence) filter()      {}
+func (ArrayPredicate) filter() {}
+func (DocumentFilter) filter() {}
+
+func Eq(field string, value interface{}) Filter  { return Comparison{field, OpEq, value} }
+func Ne(field string, value interface{}) Filter  { return Comparison{field, OpNe, value} }
+func Gt(field string, value interface{}) Filter  { return Comparison{field, OpGt, value} }
+func Gte(field string, value interface{}) Filter { return Comparison{field, OpGte, value} }
+func Lt(field string, value interface{}) Filter  { return Comparison{field, OpLt, value} }
+func Lte(field string, value interface{}) Filter { return Comparison{field, OpLte, value} }
+func In(field string, values ...interface{}) Filter {
+	return Comparison{field, OpIn, values}
+}
+func Nin(field string, values ...interface{}) Filter {
+	return Comparison{field, OpNin, values}
+}
+
+//Matches checks the field against a regular expression
+func Matches(field, pattern string) Filter { return Comparison{field, OpRegex, pattern} }
+func And(filters ...Filter) Filter         { return Logical{OpAnd, filters} }
+func Or(filters ...Filter) Filter          { return Logical{OpOr, filters} }
+func Nor(filters ...Filter) Filter         { return Logical{OpNor, filters} }
+func Not(f Filter) Filter                  { return Negation{f} }
+func Exists(field string) Filter           { return Existence{field, true} }
+func Missing(field string) Filter          { return Existence{field, false} }
+func All(field string, values ...interface{}) Filter {
+	return ArrayPredicate{field, OpAll, values}
+}
+func Size(field string, size int) Filter { return ArrayPredicate{field, OpSize, size} }
+func ElemMatch(field string, f Filter) Filter {
+	return ArrayPredicate{field, OpElemMatch, f}
+}
+
+//Where adapts an existing Document query to a Filter
+func Where(query Document) Filter { return DocumentFilter{query} }
+
+//FilterToDocument compiles a Filter into its mongo shaped Document form
+func FilterToDocument(f Filter) (Document, error) {
+	switch f := f.(type) {
+	case nil:
+		return Document{}, nil
+	case DocumentFilter:
+		if nil == f.Query {
+			return Document{}, nil
+		}
+		return f.Query, nil
+	case Comparison:
+		switch f.Op {
+		case OpEq, OpNe, OpGt, OpGte, OpLt, OpLte, OpIn, OpNin, OpRegex:
+		default:
+			return nil, fmt.Errorf("unsupported comparison operator %q", f.Op)
+		}
+		return Document{f.Field: Document{string(f.Op): f.Value}}, nil
+	case Existence:
+		return Document{f.Field: Document{"$exists": f.Exists}}, nil
+	case ArrayPredicate:
+		switch f.Op {
+		case OpAll, OpSize:
+			return Document{f.Field: Document{string(f.Op): f.Value}}, nil
+		case OpElemMatch:
+			sub, ok := f.Value.(Filter)
+			if !ok {
+				return nil, fmt.Errorf("%s expects a Filter", f.Op)
+			}
+			var doc Document
+			var err error
+			if onElement(sub) {
+				doc, err = elementCondition(sub)
+			} else {
+				doc, err = FilterToDocument(sub)
+			}
+			if nil != err {
+				return nil, err
+			}
+			return Document{f.Field: Document{string(f.Op): doc}}, nil
+		}
+		return nil, fmt.Errorf("unsupported array operator %q", f.Op)
+	case Logical:
+		switch f.Op {
+		case OpAnd, OpOr, OpNor:
+		default:
+			return nil, fmt.Errorf("unsupported logical operator %q", f.Op)
+		}
+		var clauses = make([]interface{}, len(f.Filters))
+		for i, sub := range f.Filters {
+			doc, err := FilterToDocument(sub)
+			if nil != err {
+				return nil, err
+			}
+			clauses[i] = doc
+		}
+		return Document{string(f.Op): clauses}, nil
+	case Negation:
+		doc, err := FilterToDocument(f.Filter)
+		if nil != err {
+			return nil, err
+		}
+		return Document{"$nor": []interface{}{doc}}, nil
+	}
+	return nil, fmt.Errorf("unsupported filter %T", f)
+}
+
+//onElement tells whether f refers to the array element itself, the empty field inside ElemMatch
+func onElement(f Filter) bool {
+	switch f := f.(type) {
+	case Comparison:
+		return f.Field == ""
+	case Existence:
+		return f.Field == ""
+	case ArrayPredicate:
+		return f.Field == ""
+	case Logical:
+		for _, sub := range f.Filters {
+			if onElement(sub) {
+				return true
+			}
+		}
+	case Negation:
+		return onElement(f.Filter)
+	}
+	return false
+}
+
+//elementCondition compiles a Filter on the array element itself into the operator document $elemMatch takes.
+//Only comparisons and array predicates combined with And and Not have such a form
+func elementCondition(f Filter) (Document, error) {
+	switch f := f.(type) {
+	case Comparison, ArrayPredicate:
+		doc, err := FilterToDocument(f)
+		if nil != err {
+			return nil, err
+		}
+		if cond, ok := doc[""].(Document); ok && len(doc) == 1 {
+			return cond, nil
+		}
+	case Logical:
+		if f.Op != OpAnd {
+			break
+		}
+		var cond = make(Document)
+		for _, sub := range f.Filters {
+			ops, err := elementCondition(sub)
+			if nil != err {
+				return nil, err
+			}
+			for op, v := range ops {
+				if _, dup := cond[op]; dup {
+					return nil, fmt.Errorf("%s is used twice on the element of %s", op, OpElemMatch)
+				}
+				cond[op] = v
+			}
+		}
+		return cond, nil
+	case Negation:
+		cond, err := elementCondition(f.Filter)
+		if nil != err {
+			return nil, err
+		}
+		return Document{"$not": cond}, nil
+	}
+	return nil, fmt.Errorf("%s on the element itself takes comparisons combined with And and Not, not %v", OpElemMatch, f)
+}
@@ -0,0 +1,32 @@
+package storageDriver
+
+import "time"
+
+//HealthTimeout bounds the checks Health runs against the backend
+var HealthTimeout = 5 * time.Second
+
+//HealthReport is the state of a driver as seen by Health, Err is nil when the driver is Healthy
+type HealthReport struct {
+	Driver        string
+	Healthy       bool
+	Err           error
+	Latency       time.Duration
+	ServerVersion string
+	Servers       []string
+	Pool          PoolStats
+	CheckedAt     time.Time
+}
+
+//PoolStats are the connection statistics of drivers that keep a pool, mgo collects them for the whole process
+//after EnableMongoStats and they are zero otherwise
+type PoolStats struct {
+	Clusters     int
+	MasterConns  int
+	SlaveConns   int
+	SocketsAlive int
+	SocketsInUse int
+	SocketRefs   int
+	SentOps      int
+	ReceivedOps  int
+	ReceivedDocs int
+}
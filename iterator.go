@@ -0,0 +1,53 @@
+package storageDriver
+
+import "errors"
+
+//errIterator is returned by Iter when the cursor cannot run, it yields nothing and reports err
+type errIterator struct {
+	err error
+}
+
+func (it errIterator) Next(doc interface{}) bool { return false }
+func (it errIterator) Err() error                { return it.err }
+func (it errIterator) Close() error              { return it.err }
+
+//forEach is the ForEach of every cursor, each document is decoded into a new Document so fn may keep it
+func forEach(it Iterator, fn func(Document) error) error {
+	for {
+		var doc Document
+		if !it.Next(&doc) {
+			break
+		}
+		if err := fn(doc); nil != err {
+			it.Close()
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return it.Close()
+}
+
+//mapIterator walks the documents a map cursor matched when Iter was called
+type mapIterator struct {
+	docs   []Document
+	err    error
+	closed bool
+}
+
+func (it *mapIterator) Next(doc interface{}) bool {
+	if it.closed || nil != it.err || len(it.docs) == 0 {
+		return false
+	}
+	if it.err = decodeDocument(it.docs[0], doc); nil != it.err {
+		return false
+	}
+	it.docs = it.docs[1:]
+	return true
+}
+func (it *mapIterator) Err() error { return it.err }
+func (it *mapIterator) Close() error {
+	it.closed, it.docs = true, nil
+	return it.err
+}
@@ -0,0 +1,628 @@
+package storageDriver
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+//AggregateMongo runs the pipeline in memory, supported stages are
+//$match, $project, $group, $sort, $limit, $skip, $unwind, $count and $lookup
+func (d *mapDriver) AggregateMongo(pipeline []Document) ([]Document, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var docs = append([]Document(nil), d.store[d.database][d.collection]...)
+	for _, stage := range pipeline {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage must have exactly one field, got %d", len(stage))
+		}
+		var err error
+		for name, spec := range stage {
+			switch name {
+			case "$match":
+				docs, err = aggregateMatch(docs, spec)
+			case "$project":
+				docs, err = aggregateProject(docs, spec)
+			case "$group":
+				docs, err = aggregateGroup(docs, spec)
+			case "$sort":
+				docs, err = aggregateSort(docs, spec)
+			case "$limit":
+				docs, err = aggregateLimit(docs, spec)
+			case "$skip":
+				docs, err = aggregateSkip(docs, spec)
+			case "$unwind":
+				docs, err = aggregateUnwind(docs, spec)
+			case "$count":
+				docs, err = aggregateCount(docs, spec)
+			case "$lookup":
+				docs, err = aggregateLookup(docs, spec, d.store[d.database])
+			default:
+				err = fmt.Errorf("unsupported aggregation stage %s", name)
+			}
+		}
+		if nil != err {
+			return nil, err
+		}
+	}
+	if nil == docs {
+		docs = make([]Document, 0)
+	}
+	for i, doc := range docs {
+		docs[i] = d.copyDocument(doc)
+	}
+	return docs, nil
+}
+
+func aggregateMatch(docs []Document, spec interface{}) ([]Document, error) {
+	q, ok := toDocument(spec)
+	if !ok {
+		return nil, fmt.Errorf("$match expects a document")
+	}
+	match, err := compileQuery(q)
+	if nil != err {
+		return nil, err
+	}
+	var out = make([]Document, 0, len(docs))
+	for _, doc := range docs {
+		if match(doc) {
+			out = append(out, doc)
+		}
+	}
+	return out, nil
+}
+
+func aggregateProject(docs []Document, spec interface{}) ([]Document, error) {
+	fields, ok := toDocument(spec)
+	if !ok || len(fields) == 0 {
+		return nil, fmt.Errorf("$project expects a non empty document")
+	}
+	var exclusion = true
+	for k, v := range fields {
+		if k != "_id" && !isProjectionFlag(v, false) {
+			exclusion = false
+		}
+	}
+	var out = make([]Document, len(docs))
+	for i, doc := range docs {
+		var projected = make(Document)
+		if exclusion {
+			for k, v := range doc {
+				projected[k] = v
+			}
+			for k := range fields {
+				excludePath(projected, strings.Split(k, "."))
+			}
+			out[i] = projected
+			continue
+		}
+		if v, ok := doc["_id"]; ok {
+			projected["_id"] = v
+		}
+		for k, v := range fields {
+			switch {
+			case isProjectionFlag(v, false):
+				delete(projected, k)
+			case isProjectionFlag(v, true):
+				projectPath(projected, doc, strings.Split(k, "."))
+			default:
+				val, err := evalExpression(doc, v)
+				if nil != err {
+					return nil, err
+				}
+				if err := setPath(projected, k, val); nil != err {
+					return nil, err
+				}
+			}
+		}
+		out[i] = projected
+	}
+	return out, nil
+}
+
+//isProjectionFlag reports whether v is an include (1/true) or exclude (0/false) flag
+func isProjectionFlag(v interface{}, include bool) bool {
+	if b, ok := v.(bool); ok {
+		return b == include
+	}
+	if f, ok := toFloat(v); ok {
+		return (f != 0) == include
+	}
+	return false
+}
+
+type aggregateGroupState struct {
+	id   interface{}
+	doc  Document
+	seen map[string]int
+}
+
+func aggregateGroup(docs []Document, spec interface{}) ([]Document, error) {
+	fields, ok := toDocument(spec)
+	if !ok {
+		return nil, fmt.Errorf("$group expects a document")
+	}
+	idExpr, ok := fields["_id"]
+	if !ok {
+		return nil, fmt.Errorf("$group requires an _id")
+	}
+	var accumulators = make(map[string][2]interface{}, len(fields))
+	for k, v := range fields {
+		if k == "_id" {
+			continue
+		}
+		acc, ok := toDocument(v)
+		if !ok || len(acc) != 1 {
+			return nil, fmt.Errorf("the field %s must be an accumulator object", k)
+		}
+		for op, expr := range acc {
+			switch op {
+			case "$sum", "$avg", "$min", "$max", "$push", "$addToSet", "$first", "$last":
+			default:
+				return nil, fmt.Errorf("unsupported accumulator %s", op)
+			}
+			accumulators[k] = [2]interface{}{op, expr}
+		}
+	}
+	var groups = make([]*aggregateGroupState, 0)
+	for _, doc := range docs {
+		id, err := evalExpression(doc, idExpr)
+		if nil != err {
+			return nil, err
+		}
+		var group *aggregateGroupState
+		for _, g := range groups {
+			if equalValues(g.id, id) {
+				group = g
+				break
+			}
+		}
+		if nil == group {
+			group = &aggregateGroupState{id: id, doc: Document{"_id": id}, seen: make(map[string]int)}
+			groups = append(groups, group)
+		}
+		for field, acc := range accumulators {
+			val, err := evalExpression(doc, acc[1])
+			if nil != err {
+				return nil, err
+			}
+			accumulate(group, field, acc[0].(string), val)
+		}
+	}
+	var out = make([]Document, len(groups))
+	for i, group := range groups {
+		for field, acc := range accumulators {
+			if acc[0] != "$avg" {
+				if _, ok := group.doc[field]; !ok && (acc[0] == "$push" || acc[0] == "$addToSet") {
+					group.doc[field] = make([]interface{}, 0)
+				}
+				continue
+			}
+			if n := group.seen[field]; n > 0 {
+				sum, _ := toFloat(group.doc[field])
+				group.doc[field] = sum / float64(n)
+			} else {
+				group.doc[field] = nil
+			}
+		}
+		out[i] = group.doc
+	}
+	return out, nil
+}
+
+func accumulate(group *aggregateGroupState, field, op string, val interface{}) {
+	current, exists := group.doc[field]
+	switch op {
+	case "$sum", "$avg":
+		if _, ok := toFloat(val); !ok {
+			if !exists && op == "$sum" {
+				group.doc[field] = 0
+			}
+			return
+		}
+		group.seen[field]++
+		if !exists {
+			group.doc[field] = val
+			return
+		}
+		group.doc[field] = addNumbers(current, val)
+	case "$min", "$max":
+		if nil == val {
+			return
+		}
+		c := sortCompare(val, current)
+		if !exists || nil == current || (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+			group.doc[field] = val
+		}
+	case "$push":
+		list, _ := current.([]interface{})
+		group.doc[field] = append(list, val)
+	case "$addToSet":
+		list, _ := current.([]interface{})
+		for _, v := range list {
+			if equalValues(v, val) {
+				return
+			}
+		}
+		group.doc[field] = append(list, val)
+	case "$first":
+		if !exists {
+			group.doc[field] = val
+		}
+	case "$last":
+		group.doc[field] = val
+	}
+}
+
+//addNumbers sums like $sum does, integers overflowing an int64 give a float64
+func addNumbers(a, b interface{}) interface{} {
+	n, _ := arithmetic('+', a, b)
+	return n
+}
+
+//arithmetic applies +, - or * to two numbers. Integers are computed exactly and kept in the wider type of the two,
+//an int32 grows into an int64 when the result does not fit like mongodb does. When an int64 overflows the result
+//is a float64 and exact is false
+func arithmetic(op byte, a, b interface{}) (result interface{}, exact bool) {
+	ia, okA := toInt64(a)
+	ib, okB := toInt64(b)
+	if okA && okB {
+		if n, ok := integerOp(op, ia, ib); ok {
+			return integerOf(n, a, b), true
+		}
+	}
+	fa, _ := toFloat(a)
+	fb, _ := toFloat(b)
+	switch op {
+	case '+':
+		result = fa + fb
+	case '-':
+		result = fa - fb
+	default:
+		result = fa * fb
+	}
+	return result, !(okA && okB)
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u := rv.Uint(); u <= math.MaxInt64 {
+			return int64(u), true
+		}
+	}
+	return 0, false
+}
+
+//integerOp reports false when the result overflows an int64
+func integerOp(op byte, a, b int64) (int64, bool) {
+	switch op {
+	case '+':
+		n := a + b
+		return n, (b >= 0) == (n >= a)
+	case '-':
+		n := a - b
+		return n, (b >= 0) == (n <= a)
+	}
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	n := a * b
+	return n, n/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64)
+}
+
+//integerOf converts n to the wider type of a and b, or keeps it an int64 when it does not fit
+func integerOf(n int64, a, b interface{}) interface{} {
+	t := reflect.TypeOf(a)
+	if other := reflect.TypeOf(b); other.Size() > t.Size() {
+		t = other
+	}
+	rv := reflect.New(t).Elem()
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.SetInt(n); rv.Int() == n {
+			return rv.Interface()
+		}
+	default:
+		if rv.SetUint(uint64(n)); n >= 0 && rv.Uint() == uint64(n) {
+			return rv.Interface()
+		}
+	}
+	return n
+}
+
+func aggregateSort(docs []Document, spec interface{}) ([]Document, error) {
+	var keys []string
+	var add = func(field string, order interface{}) error {
+		dir, ok := toFloat(order)
+		if !ok || (dir != 1 && dir != -1) {
+			return fmt.Errorf("$sort order of %s must be 1 or -1", field)
+		}
+		if dir < 0 {
+			field = "-" + field
+		}
+		keys = append(keys, field)
+		return nil
+	}
+	switch s := spec.(type) {
+	case bson.D:
+		for _, elem := range s {
+			if err := add(elem.Name, elem.Value); nil != err {
+				return nil, err
+			}
+		}
+	default:
+		fields, ok := toDocument(spec)
+		if !ok || len(fields) == 0 {
+			return nil, fmt.Errorf("$sort expects a non empty document")
+		}
+		//maps have no order so keys of a Document are applied alphabetically, use bson.D to control it
+		var names = make([]string, 0, len(fields))
+		for k := range fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := add(name, fields[name]); nil != err {
+				return nil, err
+			}
+		}
+	}
+	sortDocuments(docs, keys)
+	return docs, nil
+}
+
+func aggregateLimit(docs []Document, spec interface{}) ([]Document, error) {
+	n, ok := toFloat(spec)
+	if !ok || n <= 0 {
+		return nil, fmt.Errorf("$limit must be a positive number")
+	}
+	if int(n) < len(docs) {
+		docs = docs[:int(n)]
+	}
+	return docs, nil
+}
+
+func aggregateSkip(docs []Document, spec interface{}) ([]Document, error) {
+	n, ok := toFloat(spec)
+	if !ok || n < 0 {
+		return nil, fmt.Errorf("$skip must be a non negative number")
+	}
+	if int(n) >= len(docs) {
+		return docs[:0], nil
+	}
+	return docs[int(n):], nil
+}
+
+func aggregateUnwind(docs []Document, spec interface{}) ([]Document, error) {
+	var path, indexField string
+	var preserve bool
+	switch s := spec.(type) {
+	case string:
+		path = s
+	default:
+		opts, ok := toDocument(spec)
+		if !ok {
+			return nil, fmt.Errorf("$unwind expects a path or a document")
+		}
+		path, _ = opts["path"].(string)
+		preserve, _ = opts["preserveNullAndEmptyArrays"].(bool)
+		indexField, _ = opts["includeArrayIndex"].(string)
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("$unwind path must start with $")
+	}
+	field := path[1:]
+	var out = make([]Document, 0, len(docs))
+	for _, doc := range docs {
+		val, exists := doc[field]
+		elems := toSlice(val)
+		if _, isBytes := val.([]byte); !isBytes && nil == elems && exists && nil != val {
+			elems = []interface{}{val}
+		}
+		if len(elems) == 0 {
+			if preserve {
+				var cpy = shallowCopy(doc)
+				if exists && nil != val {
+					delete(cpy, field)
+				}
+				if indexField != "" {
+					cpy[indexField] = nil
+				}
+				out = append(out, cpy)
+			}
+			continue
+		}
+		for i, elem := range elems {
+			var cpy = shallowCopy(doc)
+			cpy[field] = elem
+			if indexField != "" {
+				cpy[indexField] = i
+			}
+			out = append(out, cpy)
+		}
+	}
+	return out, nil
+}
+
+func aggregateCount(docs []Document, spec interface{}) ([]Document, error) {
+	name, ok := spec.(string)
+	if !ok || name == "" || strings.HasPrefix(name, "$") {
+		return nil, fmt.Errorf("$count expects a non empty field name")
+	}
+	if len(docs) == 0 {
+		return make([]Document, 0), nil
+	}
+	return []Document{{name: len(docs)}}, nil
+}
+
+func aggregateLookup(docs []Document, spec interface{}, collections map[string][]Document) ([]Document, error) {
+	opts, ok := toDocument(spec)
+	if !ok {
+		return nil, fmt.Errorf("$lookup expects a document")
+	}
+	from, _ := opts["from"].(string)
+	localField, _ := opts["localField"].(string)
+	foreignField, _ := opts["foreignField"].(string)
+	as, _ := opts["as"].(string)
+	if from == "" || localField == "" || foreignField == "" || as == "" {
+		return nil, fmt.Errorf("$lookup requires from, localField, foreignField and as")
+	}
+	var out = make([]Document, len(docs))
+	for i, doc := range docs {
+		local := doc[localField]
+		var matches = make([]interface{}, 0)
+		for _, foreign := range collections[from] {
+			if anyValue(local, func(v interface{}) bool {
+				return anyValue(foreign[foreignField], func(w interface{}) bool { return equalValues(v, w) })
+			}) {
+				matches = append(matches, foreign)
+			}
+		}
+		var cpy = shallowCopy(doc)
+		cpy[as] = matches
+		out[i] = cpy
+	}
+	return out, nil
+}
+
+func shallowCopy(doc Document) Document {
+	var cpy = make(Document, len(doc)+1)
+	for k, v := range doc {
+		cpy[k] = v
+	}
+	return cpy
+}
+
+//evalExpression evaluates an aggregation expression: "$field" references, literals, nested documents and arrays
+//and the operators $add, $subtract, $multiply, $divide, $concat, $toLower, $toUpper, $size, $ifNull and $literal
+func evalExpression(doc Document, expr interface{}) (interface{}, error) {
+	if s, ok := expr.(string); ok {
+		if strings.HasPrefix(s, "$") {
+			return pathValue(doc, s[1:]), nil
+		}
+		return s, nil
+	}
+	if spec, ok := toDocument(expr); ok {
+		if len(spec) == 1 {
+			for op, arg := range spec {
+				if strings.HasPrefix(op, "$") {
+					return evalOperator(doc, op, arg)
+				}
+			}
+		}
+		var out = make(Document, len(spec))
+		for k, v := range spec {
+			val, err := evalExpression(doc, v)
+			if nil != err {
+				return nil, err
+			}
+			out[k] = val
+		}
+		return out, nil
+	}
+	if list, ok := expr.([]interface{}); ok {
+		var out = make([]interface{}, len(list))
+		for i, v := range list {
+			val, err := evalExpression(doc, v)
+			if nil != err {
+				return nil, err
+			}
+			out[i] = val
+		}
+		return out, nil
+	}
+	return expr, nil
+}
+
+func evalOperator(doc Document, op string, arg interface{}) (interface{}, error) {
+	if op == "$literal" {
+		return arg, nil
+	}
+	args, ok := arg.([]interface{})
+	if !ok {
+		args = []interface{}{arg}
+	}
+	var vals = make([]interface{}, len(args))
+	for i, a := range args {
+		val, err := evalExpression(doc, a)
+		if nil != err {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	switch op {
+	case "$add", "$multiply":
+		var result interface{} = 0
+		if op == "$multiply" {
+			result = 1
+		}
+		for i, v := range vals {
+			if _, ok := toFloat(v); !ok {
+				return nil, nil
+			}
+			if i == 0 {
+				result = v
+			} else if op == "$add" {
+				result = addNumbers(result, v)
+			} else {
+				result, _ = arithmetic('*', result, v)
+			}
+		}
+		return result, nil
+	case "$subtract", "$divide":
+		if len(vals) != 2 {
+			return nil, fmt.Errorf("%s expects two arguments", op)
+		}
+		a, okA := toFloat(vals[0])
+		b, okB := toFloat(vals[1])
+		if !okA || !okB {
+			return nil, nil
+		}
+		if op == "$divide" {
+			if b == 0 {
+				return nil, fmt.Errorf("can't $divide by zero")
+			}
+			return a / b, nil
+		}
+		n, _ := arithmetic('-', vals[0], vals[1])
+		return n, nil
+	case "$concat":
+		var sb strings.Builder
+		for _, v := range vals {
+			s, ok := v.(string)
+			if !ok {
+				return nil, nil
+			}
+			sb.WriteString(s)
+		}
+		return sb.String(), nil
+	case "$toLower", "$toUpper":
+		s, _ := vals[0].(string)
+		if op == "$toLower" {
+			return strings.ToLower(s), nil
+		}
+		return strings.ToUpper(s), nil
+	case "$size":
+		elems := toSlice(vals[0])
+		if nil == elems {
+			return nil, fmt.Errorf("the argument to $size must be an array")
+		}
+		return len(elems), nil
+	case "$ifNull":
+		for _, v := range vals {
+			if nil != v {
+				return v, nil
+			}
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported expression operator %s", op)
+}
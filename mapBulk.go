@@ -0,0 +1,59 @@
+package storageDriver
+
+import (
+	"context"
+	"errors"
+)
+
+//Bulk returns a BulkWriter applying the writes one after the other, each one is atomic and logged on its own
+func (d *mapDriver) Bulk() BulkWriter {
+	return &bulk{ordered: true, run: d.runBulk}
+}
+
+func (d *mapDriver) runBulk(ctx context.Context, ordered bool, ops []bulkOp, result *BulkResult) error {
+	for _, op := range ops {
+		if err := ctx.Err(); nil != err {
+			return err
+		}
+		var err error
+		switch op.kind {
+		case bulkInsert:
+			if err = d.InsertCtx(ctx, op.doc); nil == err {
+				result.Inserted++
+			}
+		case bulkUpdate, bulkUpdateAll, bulkUpsert:
+			name := "updateWith"
+			if op.kind == bulkUpdateAll {
+				name = "updateMultiWith"
+			}
+			var matched, modified int
+			var upserted Document
+			matched, modified, upserted, err = d.updateWith(ctx, name, op.query, op.update, op.kind == bulkUpdateAll, op.kind == bulkUpsert)
+			result.Matched += matched
+			result.Modified += modified
+			if nil != upserted {
+				result.Upserted++
+				result.UpsertedIDs[op.index] = upserted["_id"]
+			}
+		case bulkRemove:
+			if err = d.RemoveCtx(ctx, op.query); nil == err {
+				result.Removed++
+			}
+		case bulkRemoveAll:
+			var n int
+			n, err = d.RemoveMultiCtx(ctx, op.query)
+			result.Removed += n
+		}
+		//a write without a match is not a failure in a bulk
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+		if nil != err {
+			result.Errors = append(result.Errors, BulkItemError{Index: op.index, Err: err})
+			if ordered {
+				return nil
+			}
+		}
+	}
+	return nil
+}
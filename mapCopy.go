@@ -0,0 +1,105 @@
+package storageDriver
+
+import (
+	"reflect"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+//ZeroCopy makes the map driver store the documents it is given and return the stored ones instead of deep copies.
+//Changing a document after writing it or one that was read then changes the store, it is meant for benchmarks
+func ZeroCopy() MapOption {
+	return func(d *mapDriver) {
+		d.zeroCopy = true
+	}
+}
+
+//copyDocument deep copies doc unless the driver is in zero-copy mode, like mongodb no document shares memory with the caller
+func (d *mapDriver) copyDocument(doc Document) Document {
+	if d.zeroCopy || nil == doc {
+		return doc
+	}
+	return copyDocument(doc)
+}
+
+func (d *mapDriver) copyValue(v interface{}) interface{} {
+	if d.zeroCopy {
+		return v
+	}
+	return copyValue(v)
+}
+
+func copyDocument(doc Document) Document {
+	var cpy = make(Document, len(doc))
+	for k, v := range doc {
+		cpy[k] = copyValue(v)
+	}
+	return cpy
+}
+
+//copyValue copies maps, slices and the exported fields of structs recursively, other values are immutable
+//or copied by assignment. Pointers and unexported struct fields are kept as they are
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, string, bool, int, int32, int64, float64, time.Time, bson.ObjectId:
+		return v
+	case Document:
+		return copyDocument(v)
+	case bson.M:
+		return bson.M(copyDocument(v))
+	case []interface{}:
+		var cpy = make([]interface{}, len(v))
+		for i, item := range v {
+			cpy[i] = copyValue(item)
+		}
+		return cpy
+	}
+	return copyReflect(reflect.ValueOf(v)).Interface()
+}
+
+func copyReflect(rv reflect.Value) reflect.Value {
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.IsNil() {
+			return rv
+		}
+		var cpy = reflect.MakeMapWithSize(rv.Type(), rv.Len())
+		for _, key := range rv.MapKeys() {
+			cpy.SetMapIndex(key, copyReflect(rv.MapIndex(key)))
+		}
+		return cpy
+	case reflect.Slice:
+		if rv.IsNil() {
+			return rv
+		}
+		var cpy = reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			cpy.Index(i).Set(copyReflect(rv.Index(i)))
+		}
+		return cpy
+	case reflect.Array:
+		var cpy = reflect.New(rv.Type()).Elem()
+		for i := 0; i < rv.Len(); i++ {
+			cpy.Index(i).Set(copyReflect(rv.Index(i)))
+		}
+		return cpy
+	case reflect.Interface:
+		if rv.IsNil() {
+			return rv
+		}
+		var cpy = reflect.New(rv.Type()).Elem()
+		cpy.Set(copyReflect(rv.Elem()))
+		return cpy
+	case reflect.Struct:
+		var cpy = reflect.New(rv.Type()).Elem()
+		cpy.Set(rv)
+		for i := 0; i < cpy.NumField(); i++ {
+			if field := cpy.Field(i); field.CanSet() {
+				field.Set(copyReflect(field))
+			}
+		}
+		return cpy
+	}
+	return rv
+}
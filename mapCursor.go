@@ -0,0 +1,432 @@
+package storageDriver
+
+import (
+	"bytes"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type mapCursor struct {
+	driver   *mapDriver
+	and      Document
+	or       []interface{}
+	fields   []string
+	selected bool
+	sort     []string
+	limit    int
+	skip     int
+	where    []func(Document) bool
+	err      error
+}
+
+func (d *mapDriver) Cursor() Cursor {
+	return mapCursor{driver: d}
+}
+
+func (c mapCursor) And(Doc Document) Cursor {
+	var and = make(Document, len(c.and)+len(Doc))
+	for k, v := range c.and {
+		and[k] = v
+	}
+	for k, v := range Doc {
+		and[k] = v
+	}
+	c.and = and
+	return c
+}
+
+func (c mapCursor) Where(Query Filter) Cursor {
+	match, err := compileFilter(Query)
+	if nil != err {
+		c.err = err
+		return c
+	}
+	c.where = append(c.where[:len(c.where):len(c.where)], match)
+	return c
+}
+
+func (c mapCursor) Or(Doc []interface{}) Cursor {
+	c.or = append(c.or[:len(c.or):len(c.or)], Doc...)
+	return c
+}
+
+func (c mapCursor) Select(fields ...string) Cursor {
+	c.fields = append([]string(nil), fields...)
+	c.selected = true
+	return c
+}
+
+func (c mapCursor) Sort(Doc ...string) Cursor {
+	c.sort = append([]string(nil), Doc...)
+	return c
+}
+
+func (c mapCursor) Limit(num int) Cursor {
+	c.limit = num
+	return c
+}
+
+func (c mapCursor) Skip(num int) Cursor {
+	c.skip = num
+	return c
+}
+
+//Batch is a no-op, the map driver has no round trips
+func (c mapCursor) Batch(n int) Cursor { return c }
+
+//Prefetch is a no-op, the map driver has no round trips
+func (c mapCursor) Prefetch(p float64) Cursor { return c }
+
+//Iter matches the documents right away and decodes them one by one as Next is called
+func (c mapCursor) Iter() Iterator {
+	if nil != c.err {
+		return errIterator{c.err}
+	}
+	docs, err := c.find()
+	if nil != err {
+		return errIterator{err}
+	}
+	return &mapIterator{docs: docs}
+}
+
+func (c mapCursor) ForEach(fn func(Document) error) error {
+	return forEach(c.Iter(), fn)
+}
+
+func (c mapCursor) One(Doc interface{}) error {
+	if nil != c.err {
+		return c.err
+	}
+	docs, err := c.find()
+	if nil != err {
+		return err
+	}
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	return decodeDocument(docs[0], Doc)
+}
+
+func (c mapCursor) All(Doc interface{}) error {
+	if nil != c.err {
+		return c.err
+	}
+	docs, err := c.find()
+	if nil != err {
+		return err
+	}
+	return decodeDocuments(docs, Doc)
+}
+
+func (c mapCursor) Count(num *int) error {
+	if nil != c.err {
+		return c.err
+	}
+	docs, err := c.find()
+	if nil != err {
+		return err
+	}
+	*num = len(docs)
+	return nil
+}
+
+func (c mapCursor) Distinct(key string, result interface{}) error {
+	if nil != c.err {
+		return c.err
+	}
+	docs, err := c.match()
+	if nil != err {
+		return err
+	}
+	var values = make([]interface{}, 0)
+	for _, doc := range docs {
+		val, ok := lookupPath(doc, key)
+		if !ok {
+			continue
+		}
+		reached, ok := val.(pathValues)
+		if !ok {
+			reached = pathValues{val}
+		}
+		var candidates []interface{}
+		for _, v := range reached {
+			if array := toSlice(v); nil != array {
+				candidates = append(candidates, array...)
+			} else {
+				candidates = append(candidates, v)
+			}
+		}
+	next:
+		for _, candidate := range candidates {
+			for _, v := range values {
+				if equalValues(v, candidate) {
+					continue next
+				}
+			}
+			values = append(values, candidate)
+		}
+	}
+	data, err := bson.Marshal(bson.M{"values": values})
+	if nil != err {
+		return err
+	}
+	var raw struct{ Values bson.Raw }
+	if err := bson.Unmarshal(data, &raw); nil != err {
+		return err
+	}
+	return raw.Values.Unmarshal(result)
+}
+
+func (c mapCursor) query() Document {
+	var q = make(Document, len(c.and)+1)
+	for k, v := range c.and {
+		q[k] = v
+	}
+	if len(c.or) > 0 {
+		q["$or"] = c.or
+	}
+	return q
+}
+
+//match returns copies of every document of the collection matching the cursor's query in insertion order
+func (c mapCursor) match() ([]Document, error) {
+	d := c.driver
+	q := c.query()
+	matchQuery, err := compileQuery(q)
+	if nil != err {
+		return nil, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var docs = make([]Document, 0)
+next:
+	for _, doc := range d.plan(q) {
+		if !matchQuery(doc) {
+			continue
+		}
+		for _, match := range c.where {
+			if !match(doc) {
+				continue next
+			}
+		}
+		docs = append(docs, d.copyDocument(doc))
+	}
+	return docs, nil
+}
+
+//find applies sort, skip, limit and projection on top of match
+func (c mapCursor) find() ([]Document, error) {
+	docs, err := c.match()
+	if nil != err {
+		return nil, err
+	}
+	if len(c.sort) > 0 {
+		sortDocuments(docs, c.sort)
+	}
+	if c.skip > 0 {
+		if c.skip >= len(docs) {
+			docs = docs[:0]
+		} else {
+			docs = docs[c.skip:]
+		}
+	}
+	if c.limit > 0 && c.limit < len(docs) {
+		docs = docs[:c.limit]
+	}
+	if c.selected {
+		for i, doc := range docs {
+			docs[i] = projectDocument(doc, c.fields)
+		}
+	}
+	return docs, nil
+}
+
+//projectDocument keeps only the given fields, which may be dotted paths, and like mongoDriver.Select drops the _id
+func projectDocument(doc Document, fields []string) Document {
+	var projected = make(Document)
+	if len(fields) == 0 {
+		for k, v := range doc {
+			projected[k] = v
+		}
+	}
+	for _, field := range fields {
+		projectPath(projected, doc, strings.Split(field, "."))
+	}
+	delete(projected, "_id")
+	return projected
+}
+
+//sortDocuments sorts on several keys, a key prefixed with "-" sorts descending
+func sortDocuments(docs []Document, keys []string) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, key := range keys {
+			field, desc := key, false
+			if strings.HasPrefix(key, "-") {
+				field, desc = key[1:], true
+			} else if strings.HasPrefix(key, "+") {
+				field = key[1:]
+			}
+			c := sortCompare(pathValue(docs[i], field), pathValue(docs[j], field))
+			if c == 0 {
+				continue
+			}
+			if desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+//sortCompare orders values of different types the way mongo does: null, numbers, strings, documents, arrays,
+//binary data, ObjectId, booleans, dates, timestamps and regular expressions. It is a total order on the values
+//the indexes keep sorted, NaN sorts before every other number
+func sortCompare(a, b interface{}) int {
+	ra, rb := sortRank(a), sortRank(b)
+	switch {
+	case ra < rb:
+		return -1
+	case ra > rb:
+		return 1
+	}
+	switch ra {
+	case sortRankNumber:
+		fa, _ := toFloat(a)
+		fb, _ := toFloat(b)
+		if na, nb := math.IsNaN(fa), math.IsNaN(fb); na || nb {
+			return compareBools(nb, na)
+		}
+	case sortRankDocument:
+		da, _ := toDocument(a)
+		db, _ := toDocument(b)
+		return compareDocuments(da, db)
+	case sortRankArray:
+		return compareArrays(toSlice(a), toSlice(b))
+	case sortRankBinary:
+		ba, bb := a.([]byte), b.([]byte)
+		if len(ba) != len(bb) {
+			return compareBools(len(ba) > len(bb), len(ba) < len(bb))
+		}
+		return bytes.Compare(ba, bb)
+	case sortRankTimestamp:
+		return compareBools(a.(bson.MongoTimestamp) > b.(bson.MongoTimestamp), a.(bson.MongoTimestamp) < b.(bson.MongoTimestamp))
+	case sortRankRegex:
+		return strings.Compare(regexString(a), regexString(b))
+	}
+	c, _ := compareValues(a, b)
+	return c
+}
+
+//The ranks of sortRank, in the order mongo sorts the BSON types
+const (
+	sortRankMinKey = iota
+	sortRankNull
+	sortRankNumber
+	sortRankString
+	sortRankDocument
+	sortRankArray
+	sortRankBinary
+	sortRankObjectID
+	sortRankBool
+	sortRankDate
+	sortRankTimestamp
+	sortRankRegex
+	sortRankOther
+	sortRankMaxKey
+)
+
+func sortRank(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return sortRankNull
+	case string:
+		return sortRankString
+	case []byte:
+		return sortRankBinary
+	case bson.ObjectId:
+		return sortRankObjectID
+	case bool:
+		return sortRankBool
+	case time.Time:
+		return sortRankDate
+	case bson.MongoTimestamp:
+		return sortRankTimestamp
+	case bson.RegEx, *regexp.Regexp:
+		return sortRankRegex
+	default:
+		switch v {
+		case bson.MinKey:
+			return sortRankMinKey
+		case bson.MaxKey:
+			return sortRankMaxKey
+		}
+	}
+	if _, ok := toFloat(v); ok {
+		return sortRankNumber
+	}
+	if _, ok := toDocument(v); ok {
+		return sortRankDocument
+	}
+	if nil != toSlice(v) {
+		return sortRankArray
+	}
+	return sortRankOther
+}
+
+//compareBools turns the outcome of two comparisons into -1, 0 or 1
+func compareBools(greater, less bool) int {
+	switch {
+	case greater:
+		return 1
+	case less:
+		return -1
+	}
+	return 0
+}
+
+//compareArrays compares element by element, a prefix sorts first
+func compareArrays(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := sortCompare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return compareBools(len(a) > len(b), len(a) < len(b))
+}
+
+//compareDocuments compares the fields in the order of their names, Documents do not keep the order they were written in
+func compareDocuments(a, b Document) int {
+	ka, kb := sortedKeys(a), sortedKeys(b)
+	for i := 0; i < len(ka) && i < len(kb); i++ {
+		if c := strings.Compare(ka[i], kb[i]); c != 0 {
+			return c
+		}
+		if c := sortCompare(a[ka[i]], b[kb[i]]); c != 0 {
+			return c
+		}
+	}
+	return compareBools(len(ka) > len(kb), len(ka) < len(kb))
+}
+
+func sortedKeys(doc Document) []string {
+	var keys = make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func regexString(v interface{}) string {
+	if re, ok := v.(*regexp.Regexp); ok {
+		return re.String()
+	}
+	re := v.(bson.RegEx)
+	return re.Pattern + "/" + re.Options
+}
@@ -1,38 +1,52 @@
 package storageDriver
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"reflect"
 	"sync"
+	"time"
 )
 
+//mapDriver keeps the collections in memory. Only Driver insists on a database and a collection being chosen,
+//the other methods use the unnamed ones when they are not, like the plain insert and query methods always did
 type mapDriver struct {
 	database   string
 	collection string
-	sync.Mutex
-	store map[string]map[string][]Document
+	//mu guards the store, the indexes and the persistence. Clones share it as they share what it guards,
+	//reads hold it shared so they run in parallel and every write holds it for its whole read-modify-write
+	mu               *sync.RWMutex
+	store            map[string]map[string][]Document
+	indexes          map[string]map[string][]*mapIndex
+	persist          *mapPersistence
+	persistDir       string
+	syncWAL          bool
+	snapshotInterval time.Duration
+	zeroCopy         bool
 }
 
 func (d *mapDriver) Driver() (StorageDriver, error) {
 	if d.database == "" || d.collection == "" {
-		return nil, fmt.Errorf("database or collection is not set")
+		return nil, ErrNoCollection
 	}
 	return d, nil
 }
 
-func (d *mapDriver) AggregateMongo(doc []Document) ([]Document, error) {
-	return nil, fmt.Errorf("not implemented")
+func (d *mapDriver) Gt(Doc Document) Document  { return operatorDocument("$gt", Doc) }
+func (d *mapDriver) Gte(Doc Document) Document { return operatorDocument("$gte", Doc) }
+func (d *mapDriver) Lt(Doc Document) Document  { return operatorDocument("$lt", Doc) }
+func (d *mapDriver) Lte(Doc Document) Document { return operatorDocument("$lte", Doc) }
+func (d *mapDriver) In(key string, values []interface{}) Document {
+	return Document{key: Document{"$in": values}}
+}
+func (d *mapDriver) Between(key string, values [2]interface{}) Document {
+	return Document{key: Document{"$gte": values[0], "$lte": values[1]}}
+}
+func (d *mapDriver) Not(Doc Document) Document { return operatorDocument("$ne", Doc) }
+func (d *mapDriver) Regex(key string, value string) Document {
+	return Document{key: Document{"$regex": value}}
 }
-func (d *mapDriver) Gt(Doc Document) Document                           { return nil }
-func (d *mapDriver) Gte(Doc Document) Document                          { return nil }
-func (d *mapDriver) Lt(Doc Document) Document                           { return nil }
-func (d *mapDriver) Lte(Doc Document) Document                          { return nil }
-func (d *mapDriver) In(key string, values []interface{}) Document       { return nil }
-func (d *mapDriver) Between(key string, values [2]interface{}) Document { return nil }
-func (d *mapDriver) Not(Doc Document) Document                          { return nil }
-func (d *mapDriver) Regex(key string, value string) Document            { return nil }
-func (d *mapDriver) Cursor() Cursor                                     { return DummyCursor{} }
 func (m *mapDriver) DB(name string) error {
 	if name == "" {
 		return fmt.Errorf("empty name")
@@ -49,172 +63,364 @@ func (m *mapDriver) Table(name string) error {
 	return nil
 }
 
+func newMapDriver() *mapDriver {
+	return &mapDriver{mu: new(sync.RWMutex), store: make(map[string]map[string][]Document)}
+}
+
+//Clone shares the store and its lock, only the selected database and collection are the clone's own
 func (m *mapDriver) Clone() Meta {
 	var cpy = *m
 	return &cpy
 }
 func (d *mapDriver) Get(Query Document) ([]Document, error) {
-	if _, ok := d.store[d.database]; !ok {
-		d.store[d.database] = make(map[string][]Document)
+	return d.GetCtx(context.Background(), Query)
+}
+func (d *mapDriver) GetCtx(ctx context.Context, Query Document) ([]Document, error) {
+	match, err := compileQuery(Query)
+	if nil != err {
+		return nil, err
+	}
+	return d.get(ctx, Query, match)
+}
+func (d *mapDriver) Find(Query Filter) ([]Document, error) {
+	match, err := compileFilter(Query)
+	if nil != err {
+		return nil, err
+	}
+	plan, _ := FilterToDocument(Query)
+	return d.get(context.Background(), plan, match)
+}
+
+//get returns copies of the documents matching match, plan is the query in Document form used to pick an index.
+//No match is an empty slice like mongodb gives, not ErrNotFound
+func (d *mapDriver) get(ctx context.Context, plan Document, match func(Document) bool) ([]Document, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	docs, err := d.matching(ctx, plan, match, false)
+	if errors.Is(err, ErrNotFound) {
+		return make([]Document, 0), nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	for i, doc := range docs {
+		docs[i] = d.copyDocument(doc)
 	}
+	return docs, nil
+}
+
+//matching returns the stored documents matching match, or only the first one, the caller holds the lock.
+//ctx is checked between documents, no match is ErrNotFound
+func (d *mapDriver) matching(ctx context.Context, plan Document, match func(Document) bool, first bool) ([]Document, error) {
 	var docs = make([]Document, 0)
-	var match bool = true
-	d.Lock()
-	defer d.Unlock()
-	for _, DBDoc := range d.store[d.database][d.collection] {
-		for k, v := range Query {
-			if val, ok := DBDoc[k]; !ok || !reflect.DeepEqual(val, v) {
-				match = false
-				goto next
-			}
+	for _, DBDoc := range d.plan(plan) {
+		if err := ctx.Err(); nil != err {
+			return nil, err
 		}
-		if match {
+		if match(DBDoc) {
 			docs = append(docs, DBDoc)
+			if first {
+				break
+			}
 		}
-	next:
-		match = true
 	}
-	var err error
 	if len(docs) == 0 {
-		err = fmt.Errorf("no documents found")
+		return nil, ErrNotFound
 	}
-	return docs, err
+	return docs, nil
 }
 
 func (d *mapDriver) Insert(doc Document) error {
-	if _, ok := d.store[d.database]; !ok {
+	return d.InsertCtx(context.Background(), doc)
+}
+func (d *mapDriver) InsertCtx(ctx context.Context, doc Document) error {
+	_, err := d.InsertWithIDCtx(ctx, doc)
+	return err
+}
+
+//insert stores doc as it is giving it an _id if it has none, the caller holds the lock
+func (d *mapDriver) insert(doc Document) error {
+	if nil == d.store[d.database] {
 		d.store[d.database] = make(map[string][]Document)
 	}
-	d.Lock()
-	defer d.Unlock()
+	setID(doc)
+	d.ensureIDIndex()
+	if err := d.indexCheck(doc, nil); nil != err {
+		return err
+	}
+	if err := d.log("insert", nil, doc); nil != err {
+		return err
+	}
 	d.store[d.database][d.collection] = append(d.store[d.database][d.collection], doc)
+	d.indexAdd(doc)
 	return nil
 }
 
 func (d *mapDriver) GetOne(Query Document) (Document, error) {
-	if _, ok := d.store[d.database]; !ok {
-		d.store[d.database] = make(map[string][]Document)
+	return d.GetOneCtx(context.Background(), Query)
+}
+func (d *mapDriver) GetOneCtx(ctx context.Context, Query Document) (Document, error) {
+	match, err := compileQuery(Query)
+	if nil != err {
+		return nil, err
 	}
-	var match bool = true
-	d.Lock()
-	defer d.Unlock()
-	for _, DBDoc := range d.store[d.database][d.collection] {
-		for k, v := range Query {
-			if val, ok := DBDoc[k]; !ok || !reflect.DeepEqual(val, v) {
-				match = false
-				goto next
-			}
-		}
-		if match {
-			return DBDoc, nil
-		}
-	next:
-		match = true
+	return d.getOne(ctx, Query, match)
+}
+func (d *mapDriver) FindOne(Query Filter) (Document, error) {
+	match, err := compileFilter(Query)
+	if nil != err {
+		return nil, err
 	}
-	return nil, fmt.Errorf("no documents found")
+	plan, _ := FilterToDocument(Query)
+	return d.getOne(context.Background(), plan, match)
 }
-func (d *mapDriver) Custom(_ interface{}) ([]Document, error) {
-	if _, ok := d.store[d.database]; !ok {
-		d.store[d.database] = make(map[string][]Document)
+func (d *mapDriver) getOne(ctx context.Context, plan Document, match func(Document) bool) (Document, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	docs, err := d.matching(ctx, plan, match, true)
+	if nil != err {
+		return nil, err
 	}
-	return nil, fmt.Errorf("not implemented yet")
+	return d.copyDocument(docs[0]), nil
+}
+func (d *mapDriver) Custom(_ interface{}) ([]Document, error) {
+	return nil, ErrNotImplemented
 }
 
 func (d *mapDriver) InsertMulti(docs []Document) error {
-	if _, ok := d.store[d.database]; !ok {
-		d.store[d.database] = make(map[string][]Document)
-	}
+	return d.InsertMultiCtx(context.Background(), docs)
+}
+func (d *mapDriver) InsertMultiCtx(ctx context.Context, docs []Document) error {
 	for _, doc := range docs {
-		d.Insert(doc)
+		if err := d.InsertCtx(ctx, doc); nil != err {
+			return err
+		}
 	}
 	return nil
 }
 
-func (d *mapDriver) InsertMultiNoFail(docs []Document, _ ...io.Writer) []error {
-	if _, ok := d.store[d.database]; !ok {
-		d.store[d.database] = make(map[string][]Document)
+func (d *mapDriver) InsertMultiNoFail(docs []Document, ErrorOut ...io.Writer) []error {
+	return d.InsertMultiNoFailCtx(context.Background(), docs, ErrorOut...)
+}
+
+//InsertMultiNoFailCtx stops at the first document after ctx is done and reports ctx.Err() as the last error
+func (d *mapDriver) InsertMultiNoFailCtx(ctx context.Context, docs []Document, ErrorOut ...io.Writer) []error {
+	var errs = make([]error, 0)
+	for _, doc := range docs {
+		err := d.InsertCtx(ctx, doc)
+		if nil == err {
+			continue
+		}
+		errs = append(errs, err)
+		if len(ErrorOut) > 0 {
+			ErrorOut[0].Write([]byte(err.Error()))
+		}
+		if nil != ctx.Err() {
+			break
+		}
 	}
-	d.InsertMulti(docs)
-	return nil
+	return errs
 }
 
 func (d *mapDriver) Update(Query Document, UpdatedFields Document) error {
-	if _, ok := d.store[d.database]; !ok {
-		d.store[d.database] = make(map[string][]Document)
+	return d.UpdateCtx(context.Background(), Query, UpdatedFields)
+}
+func (d *mapDriver) UpdateCtx(ctx context.Context, Query Document, UpdatedFields Document) error {
+	match, err := compileQuery(Query)
+	if nil != err {
+		return err
 	}
-	doc, err := d.GetOne(Query)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	docs, err := d.matching(ctx, Query, match, true)
 	if nil != err {
 		return err
 	}
-	d.Lock()
-	defer d.Unlock()
-	for k, v := range UpdatedFields {
-		doc[k] = v
+	return d.update(docs[0], UpdatedFields)
+}
+
+//update sets UpdatedFields on the stored doc, the caller holds the lock
+func (d *mapDriver) update(doc, UpdatedFields Document) error {
+	if _, err := d.updateCheck(doc, UpdatedFields); nil != err {
+		return err
+	}
+	if err := d.log("update", idQuery(doc), UpdatedFields); nil != err {
+		return err
 	}
+	d.updateDocument(doc, UpdatedFields)
 	return nil
 }
 func (d *mapDriver) UpdateMulti(Query, UpdatedFields Document) (int, error) {
-	if _, ok := d.store[d.database]; !ok {
-		d.store[d.database] = make(map[string][]Document)
+	return d.UpdateMultiCtx(context.Background(), Query, UpdatedFields)
+}
+
+//UpdateMultiCtx checks ctx while looking for the documents. The change is checked against every document
+//and the unique indexes before it is logged, once logged it is applied to all of them
+func (d *mapDriver) UpdateMultiCtx(ctx context.Context, Query, UpdatedFields Document) (int, error) {
+	match, err := compileQuery(Query)
+	if nil != err {
+		return 0, err
 	}
-	docs, err := d.Get(Query)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	docs, err := d.matching(ctx, Query, match, false)
 	if nil != err {
 		return 0, err
 	}
-	d.Lock()
-	defer d.Unlock()
-	for _, doc := range docs {
-		for k, v := range UpdatedFields {
-			doc[k] = v
+	var updated = make([]Document, len(docs))
+	for i, doc := range docs {
+		if updated[i], err = d.updateCheck(doc, UpdatedFields); nil != err {
+			return 0, err
 		}
 	}
+	if err := d.indexCheckBatch(updated); nil != err {
+		return 0, err
+	}
+	if err := d.log("updateMulti", idQuery(docs...), UpdatedFields); nil != err {
+		return 0, err
+	}
+	for _, doc := range docs {
+		d.updateDocument(doc, UpdatedFields)
+	}
 	return len(docs), nil
 }
-func (d *mapDriver) Save(Query, Doc Document) error {
-	if _, ok := d.store[d.database]; !ok {
-		d.store[d.database] = make(map[string][]Document)
+
+//updateCheck makes sure UpdatedFields, whose keys may be dotted paths, can be set on the stored doc
+//and that the result keeps the _id and the unique indexes valid. It returns the updated version of doc
+func (d *mapDriver) updateCheck(doc, UpdatedFields Document) (Document, error) {
+	var updated = shallowCopy(doc)
+	for k, v := range UpdatedFields {
+		if err := setPath(updated, k, v); nil != err {
+			return nil, err
+		}
+	}
+	if err := idCheck(doc, updated); nil != err {
+		return nil, err
 	}
-	doc, err := d.GetOne(Query)
+	return updated, d.indexCheck(updated, doc)
+}
+
+//updateDocument sets copies of the values so documents never share them with the caller or each other,
+//updateCheck has made sure the paths can be set
+func (d *mapDriver) updateDocument(doc, UpdatedFields Document) {
+	d.indexRemove(doc)
+	for k, v := range UpdatedFields {
+		setPath(doc, k, d.copyValue(v))
+	}
+	d.indexAdd(doc)
+}
+func (d *mapDriver) Save(Query, Doc Document) error {
+	return d.SaveCtx(context.Background(), Query, Doc)
+}
+func (d *mapDriver) SaveCtx(ctx context.Context, Query, Doc Document) error {
+	match, err := compileQuery(Query)
 	if nil != err {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	docs, err := d.matching(ctx, Query, match, true)
+	if errors.Is(err, ErrNotFound) {
 		dd := make(Document)
 		for k, v := range Query {
-			dd[k] = v
+			if err := setPath(dd, k, v); nil != err {
+				return err
+			}
 		}
 		for k, v := range Doc {
-			dd[k] = v
+			if err := setPath(dd, k, v); nil != err {
+				return err
+			}
 		}
-		return d.Insert(dd)
+		return d.insert(d.copyDocument(dd))
+	}
+	if nil != err {
+		return err
 	}
-	return d.Update(doc, Doc)
+	return d.update(docs[0], Doc)
 }
 func (d *mapDriver) Remove(Query Document) error {
-	if _, ok := d.store[d.database]; !ok {
-		d.store[d.database] = make(map[string][]Document)
+	return d.RemoveCtx(context.Background(), Query)
+}
+func (d *mapDriver) RemoveCtx(ctx context.Context, Query Document) error {
+	match, err := compileQuery(Query)
+	if nil != err {
+		return err
 	}
-	var match bool = true
-	d.Lock()
-	defer d.Unlock()
-	for docIndex, DBDoc := range d.store[d.database][d.collection] {
-		for k, v := range Query {
-			if val, ok := DBDoc[k]; !ok || !reflect.DeepEqual(val, v) {
-				match = false
-				goto next
-			}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, DBDoc := range d.plan(Query) {
+		if err := ctx.Err(); nil != err {
+			return err
 		}
-		if match {
-			d.store[d.database][d.collection] = append(d.store[d.database][d.collection][:docIndex], d.store[d.database][d.collection][docIndex+1:]...)
+		if match(DBDoc) {
+			if err := d.log("remove", idQuery(DBDoc), nil); nil != err {
+				return err
+			}
+			d.store[d.database][d.collection] = removeDocument(d.store[d.database][d.collection], DBDoc)
+			d.indexRemove(DBDoc)
 			return nil
 		}
-	next:
-		match = true
 	}
 
-	return fmt.Errorf("no document removed")
+	return ErrNotFound
+}
+
+func (d *mapDriver) RemoveMulti(Query Document) (int, error) {
+	return d.RemoveMultiCtx(context.Background(), Query)
+}
+
+//RemoveMultiCtx checks ctx while looking for the documents, then compacts the collection in a single pass
+func (d *mapDriver) RemoveMultiCtx(ctx context.Context, Query Document) (int, error) {
+	match, err := compileQuery(Query)
+	if nil != err {
+		return 0, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	docs := d.store[d.database][d.collection]
+	var matched = make([]bool, len(docs))
+	var removed []Document
+	for i, DBDoc := range docs {
+		if err := ctx.Err(); nil != err {
+			return 0, err
+		}
+		if match(DBDoc) {
+			matched[i] = true
+			removed = append(removed, DBDoc)
+		}
+	}
+	n := len(removed)
+	if n == 0 {
+		return 0, nil
+	}
+	if err := d.log("removeMulti", idQuery(removed...), nil); nil != err {
+		return 0, err
+	}
+	kept := docs[:0]
+	for i, DBDoc := range docs {
+		if matched[i] {
+			d.indexRemove(DBDoc)
+			continue
+		}
+		kept = append(kept, DBDoc)
+	}
+	for i := len(kept); i < len(docs); i++ {
+		docs[i] = nil
+	}
+	d.store[d.database][d.collection] = kept
+	return n, nil
 }
 
-func NewMapDriver() Meta {
+func NewMapDriver(options ...MapOption) Meta {
 	fmt.Println("!MapDriver has been deprecated and will be removed in the future releases of storageDriver please use other in memory driver alternatives like ql driver")
-	var driver = new(mapDriver)
-	driver.store = make(map[string]map[string][]Document)
+	var driver = newMapDriver()
+	driver.snapshotInterval = DefaultSnapshotInterval
+	for _, option := range options {
+		option(driver)
+	}
+	if driver.persistDir != "" {
+		driver.openPersistence(driver.persistDir)
+	}
 	return driver
 }
@@ -1,10 +1,25 @@
 package storageDriver
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
 )
 
-var d = new(mapDriver)
+var d = newMapDriver()
 
 func Test_Insert(t *testing.T) {
 	d.store = make(map[string]map[string][]Document)
@@ -36,8 +51,8 @@ func Test_Get(t *testing.T) {
 		t.Fatal("somethign weird is happening")
 	}
 	docs, err = d.Get(Document{"num": 550})
-	if nil == err {
-		t.Fatal("error cannot be nil here")
+	if nil != err || len(docs) != 0 {
+		t.Fatal("no match is supposed to give an empty slice", docs, err)
 	}
 }
 func Test_GetOne(t *testing.T) {
@@ -96,10 +111,126 @@ func Test_UpdateMulti(t *testing.T) {
 	if n != 500 {
 		t.Fatal("n is supposed to be 500 WTH!")
 	}
-	if docs[0]["num"] != 10 || docs[10]["testField"] != "test" {
+	if docs[0]["num"] != 12 || nil != docs[10]["testField"] {
+		t.Fatal("the documents read before the update are not supposed to change")
+	}
+	docs, err = d.Get(Document{"num": 10})
+	if nil != err || len(docs) != 500 || docs[10]["testField"] != "test" {
 		t.Fatal("multi update unsuccessful")
 	}
 }
+func Test_ID(t *testing.T) {
+	dir := t.TempDir()
+	meta, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	m := meta.(*mapDriver)
+	m.DB("db")
+	m.Table("col")
+	var ids []interface{}
+	for i := 0; i < 100; i++ {
+		id, err := m.InsertWithID(Document{"num": i})
+		if nil != err {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if docs := m.plan(Document{"_id": ids[50]}); len(docs) != 1 || docs[0]["num"] != 50 {
+		t.Fatal("a lookup by _id is supposed to use the _id index", len(docs))
+	}
+	if err := m.EnsureIndex("_id"); nil != err {
+		t.Fatal("the _id index always exists", err)
+	}
+	upserted, err := m.FindAndUpdate(Document{"num": 100}, NewUpdate().Set("new", true), FindAndUpdateOptions{Upsert: true, ReturnNew: true})
+	if _, ok := upserted["_id"]; nil != err || !ok {
+		t.Fatal("an upserted document is supposed to get an _id", upserted, err)
+	}
+	if _, err := m.UpdateMulti(Document{"num": Document{"$lt": 2}}, Document{"_id": 5}); !errors.Is(err, ErrImmutableID) {
+		t.Fatal("UpdateMulti is supposed to reject a change of the _id", err)
+	}
+	m.Insert(Document{"a": "x"})
+	if _, err := m.UpdateMulti(Document{"a": "x"}, Document{"a.b": 5}); nil == err {
+		t.Fatal("UpdateMulti is supposed to reject a path through a string")
+	}
+	if docs, _ := m.Get(Document{"num": Document{"$lt": 2}}); len(docs) != 2 || docs[0]["_id"] != ids[0] {
+		t.Fatal("a rejected UpdateMulti changed documents", docs)
+	}
+	m.Close()
+	reopened, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal("a rejected UpdateMulti is not supposed to be logged", err)
+	}
+	r := reopened.(*mapDriver)
+	r.DB("db")
+	r.Table("col")
+	if doc, err := r.GetOne(Document{"_id": ids[7]}); nil != err || doc["num"] != 7 {
+		t.Fatal("the generated _id is supposed to be persisted", doc, err)
+	}
+	if doc, err := r.GetOne(Document{"_id": upserted["_id"]}); nil != err || doc["new"] != true {
+		t.Fatal("the _id of an upsert is supposed to be persisted", doc, err)
+	}
+	if err := r.Insert(Document{"_id": ids[7]}); !isDuplicateKey(err) {
+		t.Fatal("the _id is supposed to stay unique after reopening", err)
+	}
+	r.Close()
+}
+func Test_Isolation(t *testing.T) {
+	var m = newMapDriver()
+	m.DB("db")
+	m.Table("col")
+	doc := Document{"num": 1, "address": Document{"city": "Izmir"}, "tags": []interface{}{"a", Document{"b": 1}}, "scores": []int{1, 2}}
+	m.Insert(doc)
+	doc["num"] = 2
+	doc["address"].(Document)["city"] = "Ankara"
+	doc["tags"].([]interface{})[1].(Document)["b"] = 2
+	doc["scores"].([]int)[0] = 5
+	got, err := m.GetOne(Document{"num": 1})
+	if nil != err {
+		t.Fatal("changing an inserted document changed the store", err)
+	}
+	if got["address"].(Document)["city"] != "Izmir" || got["tags"].([]interface{})[1].(Document)["b"] != 1 || got["scores"].([]int)[0] != 1 {
+		t.Fatal("nested values are shared with the caller", got)
+	}
+	got["address"].(Document)["city"] = "Bursa"
+	again, _ := m.GetOne(Document{"num": 1})
+	if again["address"].(Document)["city"] != "Izmir" {
+		t.Fatal("changing a read document changed the store")
+	}
+	change := Document{"list": []interface{}{1}}
+	m.Update(Document{"num": 1}, change)
+	change["list"].([]interface{})[0] = 2
+	m.UpdateWith(Document{"num": 1}, NewUpdate().Set("address", Document{"city": "Izmir"}))
+	again, _ = m.GetOne(Document{"num": 1})
+	if again["list"].([]interface{})[0] != 1 {
+		t.Fatal("an update shares its values with the caller")
+	}
+	type holder struct {
+		Items []int
+		Meta  map[string]int
+	}
+	value := holder{Items: []int{1}, Meta: map[string]int{"a": 1}}
+	m.Insert(Document{"num": 3, "holder": value})
+	value.Items[0], value.Meta["a"] = 2, 2
+	held, _ := m.GetOne(Document{"num": 3})
+	if h := held["holder"].(holder); h.Items[0] != 1 || h.Meta["a"] != 1 {
+		t.Fatal("the fields of a stored struct are shared with the caller", h)
+	}
+	held["holder"].(holder).Items[0] = 3
+	if held, _ = m.GetOne(Document{"num": 3}); held["holder"].(holder).Items[0] != 1 {
+		t.Fatal("changing the fields of a read struct changed the store")
+	}
+	var zero = newMapDriver()
+	ZeroCopy()(zero)
+	zero.DB("db")
+	zero.Table("col")
+	doc = Document{"num": 1}
+	zero.Insert(doc)
+	doc["num"] = 2
+	if _, err := zero.GetOne(Document{"num": 2}); nil != err {
+		t.Fatal("ZeroCopy is supposed to keep the inserted document", err)
+	}
+}
 func Test_Save(t *testing.T) {
 
 	d.store = make(map[string]map[string][]Document)
@@ -144,3 +275,1103 @@ func Test_Remove(t *testing.T) {
 		t.Fatal("remove doesnt remove values")
 	}
 }
+func Test_Operators(t *testing.T) {
+	d.store = make(map[string]map[string][]Document)
+	for i := 0; i < 100; i++ {
+		d.Insert(Document{"num": i, "name": "name" + string(rune('a'+i%26)), "tags": []interface{}{"t", i % 3}})
+	}
+	if docs, _ := d.Get(d.Gt(Document{"num": 89})); len(docs) != 10 {
+		t.Fatal("$gt returned wrong number of documents", len(docs))
+	}
+	if docs, _ := d.Get(d.Gte(Document{"num": 90})); len(docs) != 10 {
+		t.Fatal("$gte returned wrong number of documents", len(docs))
+	}
+	if docs, _ := d.Get(d.Lt(Document{"num": 10.5})); len(docs) != 11 {
+		t.Fatal("$lt is supposed to compare across numeric types", len(docs))
+	}
+	if docs, _ := d.Get(d.Lte(Document{"num": 9})); len(docs) != 10 {
+		t.Fatal("$lte returned wrong number of documents", len(docs))
+	}
+	if docs, _ := d.Get(d.In("num", []interface{}{1, 2, 500})); len(docs) != 2 {
+		t.Fatal("$in returned wrong number of documents", len(docs))
+	}
+	if docs, _ := d.Get(d.Between("num", [2]interface{}{10, 19})); len(docs) != 10 {
+		t.Fatal("between returned wrong number of documents", len(docs))
+	}
+	if docs, _ := d.Get(d.Not(Document{"num": 0})); len(docs) != 99 {
+		t.Fatal("$ne returned wrong number of documents", len(docs))
+	}
+	if docs, _ := d.Get(d.Regex("name", "^name[ab]$")); len(docs) != 8 {
+		t.Fatal("$regex returned wrong number of documents", len(docs))
+	}
+	if docs, _ := d.Get(Document{"tags": 2}); len(docs) != 33 {
+		t.Fatal("array fields are supposed to match on any element", len(docs))
+	}
+	if docs, _ := d.Get(Document{"$or": []interface{}{Document{"num": 1}, Document{"num": 2}}}); len(docs) != 2 {
+		t.Fatal("$or returned wrong number of documents", len(docs))
+	}
+	if err := d.Remove(d.Gt(Document{"num": 98})); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := d.GetOne(Document{"num": 99}); nil == err {
+		t.Fatal("remove is supposed to understand operators")
+	}
+	compiled, err := compileQueryDocument(Document{"$or": []interface{}{d.Regex("name", "^namea$"), Document{"name": Document{"$not": "b"}}}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	or := compiled["$or"].([]interface{})
+	if _, ok := or[0].(Document)["name"].(Document)["$regex"].(*regexp.Regexp); !ok {
+		t.Fatal("$regex is supposed to be compiled with the query", compiled)
+	}
+	if _, ok := or[1].(Document)["name"].(Document)["$not"].(*regexp.Regexp); !ok {
+		t.Fatal("$not is supposed to compile its regular expression with the query", compiled)
+	}
+	for _, q := range []Document{{"num": Document{"$foo": 1}}, {"$foo": 1}, {"name": Document{"$regex": "("}}, {"$or": 1}} {
+		if _, err := d.Get(q); nil == err {
+			t.Error(q, "is supposed to be an error")
+		}
+	}
+	if _, err := d.Find(Where(Document{"num": Document{"$foo": 1}})); nil == err {
+		t.Fatal("Find is supposed to reject an unknown operator")
+	}
+	if err := d.UpdateWith(Document{}, NewUpdate().Pull("tags", Document{"$foo": 1})); nil == err {
+		t.Fatal("$pull is supposed to reject an unknown operator")
+	}
+}
+func Test_Cursor(t *testing.T) {
+	d.store = make(map[string]map[string][]Document)
+	for i := 0; i < 100; i++ {
+		d.Insert(Document{"_id": i, "num": i, "group": i % 5, "name": "doc"})
+	}
+	var docs []Document
+	err := d.Cursor().And(d.Gte(Document{"num": 50})).Sort("-group", "num").Skip(2).Limit(5).All(&docs)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(docs) != 5 {
+		t.Fatal("limit is not applied", len(docs))
+	}
+	if docs[0]["group"] != 4 || docs[0]["num"] != 64 || docs[4]["num"] != 84 {
+		t.Fatal("sort or skip is not applied", docs)
+	}
+	var typed []struct {
+		Num  int
+		Name string
+	}
+	if err := d.Cursor().Or([]interface{}{Document{"num": 1}, Document{"num": 2}}).Select("num").All(&typed); nil != err {
+		t.Fatal(err)
+	}
+	if len(typed) != 2 || typed[1].Num != 2 || typed[1].Name != "" {
+		t.Fatal("or or select is not applied", typed)
+	}
+	var one Document
+	if err := d.Cursor().And(Document{"num": 3}).Select("num").One(&one); nil != err {
+		t.Fatal(err)
+	}
+	if _, ok := one["_id"]; ok || one["num"] != 3 {
+		t.Fatal("select is supposed to drop the _id", one)
+	}
+	if err := d.Cursor().And(Document{"num": 300}).One(&one); nil == err {
+		t.Fatal("error cannot be nil here")
+	}
+	var n int
+	if err := d.Cursor().And(d.Lt(Document{"num": 10})).Count(&n); nil != err || n != 10 {
+		t.Fatal("count is wrong", n, err)
+	}
+	var groups []int
+	if err := d.Cursor().And(d.Lt(Document{"num": 50})).Distinct("group", &groups); nil != err {
+		t.Fatal(err)
+	}
+	if len(groups) != 5 {
+		t.Fatal("distinct is wrong", groups)
+	}
+	d.Insert(Document{"num": 200, "address": Document{"city": "x"}, "items": []interface{}{Document{"qty": 1}, Document{"qty": []interface{}{2, 1}}}})
+	d.Insert(Document{"num": 201, "address": Document{"city": "y"}})
+	var cities []string
+	if err := d.Cursor().Distinct("address.city", &cities); nil != err || len(cities) != 2 {
+		t.Fatal("distinct doesnt follow dotted paths", cities, err)
+	}
+	var qty []int
+	if err := d.Cursor().Distinct("items.qty", &qty); nil != err || len(qty) != 2 {
+		t.Fatal("distinct doesnt fan out over arrays", qty, err)
+	}
+}
+func Test_Filter(t *testing.T) {
+	d.store = make(map[string]map[string][]Document)
+	for i := 0; i < 100; i++ {
+		d.Insert(Document{"num": i, "tags": []interface{}{i % 2, i % 3}, "items": []interface{}{Document{"qty": i}}})
+	}
+	d.Insert(Document{"other": true})
+	var cases = []struct {
+		filter Filter
+		count  int
+	}{
+		{Eq("num", 5), 1},
+		{And(Gte("num", 10), Lt("num", 20)), 10},
+		{Or(Eq("num", 1), In("num", 2, 3, 500)), 3},
+		{Not(Lt("num", 90)), 11},
+		{Nor(Exists("num"), Gt("num", 1000)), 1},
+		{Missing("num"), 1},
+		{All("tags", 1, 2), 16},
+		{All("tags"), 0},
+		{Eq("num", nil), 1},
+		{Ne("num", nil), 100},
+		{In("num", nil, 5), 2},
+		{Nin("num", nil, 5), 99},
+		{Eq("items.qty", nil), 1},
+		{Size("tags", 2), 100},
+		{ElemMatch("items", Gt("qty", 97)), 2},
+		{ElemMatch("tags", Eq("", 2)), 33},
+		{ElemMatch("tags", And(Gte("", 1), Lt("", 2))), 66},
+		{ElemMatch("tags", Not(Eq("", 0))), 83},
+		{Where(d.Between("num", [2]interface{}{0, 4})), 5},
+		{Matches("num", "."), 0},
+	}
+	for i, c := range cases {
+		docs, _ := d.Find(c.filter)
+		if len(docs) != c.count {
+			t.Fatal("case", i, "returned", len(docs), "documents instead of", c.count)
+		}
+		q, err := FilterToDocument(c.filter)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if docs, _ := d.Get(q); len(docs) != c.count {
+			t.Fatal("case", i, "compiled to", q, "which returned", len(docs), "documents instead of", c.count)
+		}
+	}
+	if _, err := d.FindOne(Comparison{"num", OpAll, 1}); nil == err {
+		t.Fatal("invalid operators are supposed to give an error")
+	}
+	if q, err := FilterToDocument(ElemMatch("tags", And(Gte("", 1), Lt("", 2)))); nil != err || len(q["tags"].(Document)["$elemMatch"].(Document)) != 2 {
+		t.Fatal("And on the element is supposed to give a single operator document", q, err)
+	}
+	for _, f := range []Filter{ElemMatch("tags", Or(Eq("", 1), Eq("", 2))), ElemMatch("items", And(Gt("qty", 1), Eq("", 2))), ElemMatch("tags", Exists(""))} {
+		if _, err := FilterToDocument(f); nil == err {
+			t.Error(f, "has no mongodb form and is supposed to give an error")
+		}
+		if _, err := d.Find(f); nil == err {
+			t.Error(f, "is supposed to give the same error on the map driver")
+		}
+	}
+	var n int
+	if err := d.Cursor().Where(Gt("num", 49)).And(d.Lt(Document{"num": 60})).Count(&n); nil != err || n != 10 {
+		t.Fatal("cursor doesnt apply the filter", n, err)
+	}
+}
+func Test_AggregateMongo(t *testing.T) {
+	d.store = make(map[string]map[string][]Document)
+	d.DB("aggregate")
+	d.Table("orders")
+	for i := 0; i < 20; i++ {
+		d.Insert(Document{"_id": i, "customer": i % 4, "total": i, "items": []interface{}{"a", "b"}})
+	}
+	docs, err := d.AggregateMongo([]Document{
+		{"$match": d.Gte(Document{"total": 4})},
+		{"$group": Document{
+			"_id":      "$customer",
+			"sum":      Document{"$sum": "$total"},
+			"avg":      Document{"$avg": "$total"},
+			"min":      Document{"$min": "$total"},
+			"max":      Document{"$max": "$total"},
+			"count":    Document{"$sum": 1},
+			"orders":   Document{"$push": "$_id"},
+			"products": Document{"$addToSet": "$items"},
+			"first":    Document{"$first": "$_id"},
+			"last":     Document{"$last": "$_id"},
+		}},
+		{"$sort": Document{"_id": -1}},
+		{"$skip": 1},
+		{"$limit": 2},
+		{"$project": Document{"sum": 1, "avg": 1, "count": 1, "min": 1, "max": 1, "orders": 1, "first": 1, "last": 1, "label": Document{"$concat": []interface{}{"customer-", "x"}}}},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatal("wrong number of groups", docs)
+	}
+	if docs[0]["_id"] != 2 || docs[0]["sum"] != 6+10+14+18 || docs[0]["avg"] != 12.0 || docs[0]["count"] != 4 {
+		t.Fatal("group accumulators are wrong", docs[0])
+	}
+	if docs[0]["min"] != 6 || docs[0]["max"] != 18 || docs[0]["first"] != 6 || docs[0]["last"] != 18 || len(docs[0]["orders"].([]interface{})) != 4 {
+		t.Fatal("group accumulators are wrong", docs[0])
+	}
+	if docs[0]["label"] != "customer-x" {
+		t.Fatal("project expressions are wrong", docs[0])
+	}
+	if _, ok := docs[0]["products"]; ok {
+		t.Fatal("project is supposed to drop unlisted fields", docs[0])
+	}
+	docs, err = d.AggregateMongo([]Document{{"$unwind": "$items"}, {"$count": "n"}})
+	if nil != err || len(docs) != 1 || docs[0]["n"] != 40 {
+		t.Fatal("unwind or count is wrong", docs, err)
+	}
+	d.Table("customers")
+	for i := 0; i < 4; i++ {
+		d.Insert(Document{"_id": i, "name": "customer"})
+	}
+	docs, err = d.AggregateMongo([]Document{
+		{"$lookup": Document{"from": "orders", "localField": "_id", "foreignField": "customer", "as": "orders"}},
+		{"$match": Document{"_id": 1}},
+	})
+	if nil != err || len(docs) != 1 || len(docs[0]["orders"].([]interface{})) != 5 {
+		t.Fatal("lookup is wrong", docs, err)
+	}
+	if doc, _ := d.GetOne(Document{"_id": 1}); nil != doc["orders"] {
+		t.Fatal("aggregation must not change the stored documents")
+	}
+	d.Table("nested")
+	d.Insert(Document{"_id": 1, "a": Document{"b": 1, "c": 2}, "items": []interface{}{Document{"x": 1, "y": 2}}})
+	docs, err = d.AggregateMongo([]Document{{"$project": Document{"a.b": 1, "items.x": 1, "n.m": "$a.c"}}})
+	if nil != err || len(docs) != 1 || !reflect.DeepEqual(docs[0], Document{"_id": 1, "a": Document{"b": 1}, "items": []interface{}{Document{"x": 1}}, "n": Document{"m": 2}}) {
+		t.Fatal("project doesnt follow dotted paths", docs, err)
+	}
+	docs, err = d.AggregateMongo([]Document{{"$project": Document{"a.b": 0, "items.y": 0}}})
+	if nil != err || len(docs) != 1 || !reflect.DeepEqual(docs[0], Document{"_id": 1, "a": Document{"c": 2}, "items": []interface{}{Document{"x": 1}}}) {
+		t.Fatal("project doesnt exclude dotted paths", docs, err)
+	}
+	if doc, _ := d.GetOne(Document{"_id": 1}); !reflect.DeepEqual(doc["a"], Document{"b": 1, "c": 2}) {
+		t.Fatal("project must not change the stored documents", doc)
+	}
+	if _, err := d.AggregateMongo([]Document{{"$out": "x"}}); nil == err {
+		t.Fatal("unsupported stages are supposed to give an error")
+	}
+}
+
+//openMapDriver creates a persistent map driver and returns the error it could not be opened with
+func openMapDriver(dir string, options ...MapOption) (Meta, error) {
+	m := NewMapDriver(append([]MapOption{WithPersistence(dir)}, options...)...)
+	return m, m.Ping(context.Background())
+}
+func Test_Persistence(t *testing.T) {
+	dir := t.TempDir()
+	m, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	m.DB("persist")
+	m.Table("docs")
+	p, _ := m.Driver()
+	m.EnsureUniqueIndex("num")
+	for i := 0; i < 10; i++ {
+		p.Insert(Document{"num": i})
+	}
+	p.Update(Document{"num": 1}, Document{"updated": true})
+	p.UpdateMulti(m.(*mapDriver).Gt(Document{"num": 7}), Document{"big": true})
+	p.Remove(Document{"num": 0})
+	p.Save(Document{"num": 20}, Document{"saved": true})
+
+	var check = func(m Meta) {
+		m.DB("persist")
+		m.Table("docs")
+		p, _ := m.Driver()
+		if docs, _ := p.Get(Document{}); len(docs) != 10 {
+			t.Fatal("wrong number of documents after reopening", len(docs))
+		}
+		if doc, err := p.GetOne(Document{"num": 1}); nil != err || doc["updated"] != true {
+			t.Fatal("update is not persisted", doc, err)
+		}
+		if docs, _ := p.Get(Document{"big": true}); len(docs) != 2 {
+			t.Fatal("multi update is not persisted", docs)
+		}
+		if _, err := p.GetOne(Document{"num": 0}); nil == err {
+			t.Fatal("remove is not persisted")
+		}
+		if doc, err := p.GetOne(Document{"num": 20}); nil != err || doc["saved"] != true {
+			t.Fatal("save is not persisted", doc, err)
+		}
+		if err := p.Insert(Document{"num": 5}); !isDuplicateKey(err) {
+			t.Fatal("indexes are not persisted", err)
+		}
+	}
+	reopened, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	check(reopened)
+	if err := m.(*mapDriver).snapshot(); nil != err {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, mapWALFile)); nil != err || info.Size() != 0 {
+		t.Fatal("snapshot is supposed to truncate the log", err)
+	}
+	reopened, err = openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	check(reopened)
+
+	f, _ := os.OpenFile(filepath.Join(dir, mapWALFile), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0xff, 0, 0})
+	f.Close()
+	reopened, err = openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal("a partially written record is supposed to be ignored", err)
+	}
+	check(reopened)
+
+	os.WriteFile(filepath.Join(dir, mapSnapshotFile), []byte("corrupt"), 0644)
+	broken, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil == err {
+		t.Fatal("a corrupt snapshot is supposed to be reported by Ping")
+	}
+	broken.DB("persist")
+	broken.Table("docs")
+	if p, _ := broken.Driver(); nil == p.Insert(Document{"num": 100}) {
+		t.Fatal("a driver that could not be opened is supposed to refuse writes")
+	}
+	if _, err := Open("mem:///persist/docs?snapshot=0&dir=" + dir); nil == err {
+		t.Fatal("Open is supposed to report the error the driver could not be opened with")
+	}
+}
+func Test_WAL(t *testing.T) {
+	dir := t.TempDir()
+	wal := filepath.Join(dir, mapWALFile)
+	m, err := openMapDriver(dir, SnapshotInterval(0), SyncWAL(true))
+	if nil != err {
+		t.Fatal(err)
+	}
+	m.DB("db")
+	m.Table("col")
+	p, _ := m.Driver()
+	p.Insert(Document{"_id": 1, "n": 0})
+	p.UpdateWith(Document{"_id": 1}, NewUpdate().Inc("n", 1))
+	//a crash after the snapshot is renamed but before the log is truncated leaves both behind
+	logged, _ := os.ReadFile(wal)
+	if err := m.(*mapDriver).snapshot(); nil != err {
+		t.Fatal(err)
+	}
+	os.WriteFile(wal, logged, 0644)
+	reopened, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	reopened.DB("db")
+	reopened.Table("col")
+	p, _ = reopened.Driver()
+	if doc, _ := p.GetOne(Document{"_id": 1}); doc["n"] != 1 {
+		t.Fatal("records the snapshot holds are supposed to be skipped", doc)
+	}
+	//records logged after the reopen keep counting from the snapshot
+	p.UpdateWith(Document{"_id": 1}, NewUpdate().Inc("n", 1))
+	reopened, _ = openMapDriver(dir, SnapshotInterval(0))
+	reopened.DB("db")
+	reopened.Table("col")
+	p, _ = reopened.Driver()
+	if doc, _ := p.GetOne(Document{"_id": 1}); doc["n"] != 2 {
+		t.Fatal("a record logged after the reopen is not replayed", doc)
+	}
+
+	//a write the log cannot take is refused, the damaged log refuses the ones after it
+	p.(*mapDriver).persist.wal.Close()
+	if err := p.Insert(Document{"_id": 2}); nil == err {
+		t.Fatal("a write the log cannot take is supposed to fail")
+	}
+	if err := reopened.Ping(context.Background()); nil == err {
+		t.Fatal("Ping is supposed to report the damaged log")
+	}
+	if _, err := p.GetOne(Document{"_id": 2}); !errors.Is(err, ErrNotFound) {
+		t.Fatal("a write that was not logged is not supposed to be applied", err)
+	}
+
+	var header [4]byte
+	binary.LittleEndian.PutUint32(header[:], 1<<30)
+	f, _ := os.OpenFile(wal, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(header[:])
+	f.Close()
+	if _, err := openMapDriver(dir, SnapshotInterval(0)); nil == err || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatal("a record longer than the limit is supposed to be corruption", err)
+	}
+}
+func Test_ReplayByID(t *testing.T) {
+	dir := t.TempDir()
+	meta, _ := openMapDriver(dir, SnapshotInterval(0))
+	m := meta.(*mapDriver)
+	m.DB("db")
+	m.Table("col")
+	m.EnsureIndex("status")
+	m.Insert(Document{"name": "A", "status": "x"})
+	m.Insert(Document{"name": "B", "status": "x"})
+	m.Update(Document{"name": "A"}, Document{"n": 1})
+	m.snapshot()
+	m.Remove(Document{"status": "x"})
+	survivor, _ := m.GetOne(Document{"status": "x"})
+	reopened, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	reopened.DB("db")
+	reopened.Table("col")
+	if doc, err := reopened.(*mapDriver).GetOne(Document{"status": "x"}); nil != err || doc["name"] != survivor["name"] {
+		t.Fatal("a replay is supposed to remove the document removed at runtime", survivor, doc, err)
+	}
+	//a snapshot written before documents had an _id is given ids which the log refers to from then on
+	m.database, m.collection = "db", "legacy"
+	m.Insert(Document{"name": "C"})
+	delete(m.store["db"]["legacy"][0], "_id")
+	m.indexes["db"]["legacy"] = nil
+	m.snapshot()
+	first, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	first.DB("db")
+	first.Table("legacy")
+	first.(*mapDriver).Update(Document{"name": "C"}, Document{"n": 1})
+	second, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal("the ids given while loading are supposed to be persisted", err)
+	}
+	second.DB("db")
+	second.Table("legacy")
+	if doc, err := second.(*mapDriver).GetOne(Document{"name": "C"}); nil != err || doc["n"] != 1 {
+		t.Fatal(doc, err)
+	}
+}
+func Test_EnsureIndex(t *testing.T) {
+	d.store = make(map[string]map[string][]Document)
+	d.indexes = nil
+	d.DB("indexes")
+	d.Table("docs")
+	for i := 0; i < 1000; i++ {
+		d.Insert(Document{"num": i, "group": i % 10, "email": "user" + strconv.Itoa(i)})
+	}
+	if err := d.EnsureIndex("group", "-num"); nil != err {
+		t.Fatal(err)
+	}
+	if err := d.EnsureUniqueIndex("email"); nil != err {
+		t.Fatal(err)
+	}
+	if err := d.EnsureIndex("email"); nil == err {
+		t.Fatal("an existing index with different options is supposed to give an error")
+	}
+	if docs, _ := d.Get(Document{"group": 3, "num": Document{"$in": []interface{}{3, 13, 14}}}); len(docs) != 2 {
+		t.Fatal("hash index lookup is wrong", docs)
+	}
+	if docs, _ := d.Get(Document{"group": Document{"$gte": 8}}); len(docs) != 200 {
+		t.Fatal("range index lookup is wrong", len(docs))
+	}
+	if docs, _ := d.Find(And(Eq("email", "user5"), Exists("num"))); len(docs) != 1 {
+		t.Fatal("filters are supposed to use indexes", docs)
+	}
+	err := d.Insert(Document{"email": "user5"})
+	if _, ok := err.(*DuplicateKeyError); !ok {
+		t.Fatal("unique index is supposed to reject duplicates with a *DuplicateKeyError", err)
+	}
+	if err := d.Update(Document{"email": "user6"}, Document{"email": "user7"}); !isDuplicateKey(err) {
+		t.Fatal("unique index is supposed to reject duplicate updates", err)
+	}
+	if err := d.Update(Document{"email": "user6"}, Document{"email": "user6", "group": 100}); nil != err {
+		t.Fatal(err)
+	}
+	if doc, err := d.GetOne(Document{"group": 100}); nil != err || doc["email"] != "user6" {
+		t.Fatal("index is not updated", doc, err)
+	}
+	if err := d.Remove(Document{"email": "user6"}); nil != err {
+		t.Fatal(err)
+	}
+	if err := d.Insert(Document{"email": "user6"}); nil != err {
+		t.Fatal("index is not cleaned up on remove", err)
+	}
+	if err := d.Insert(Document{"email": []interface{}{"a", "b"}}); nil != err {
+		t.Fatal(err)
+	}
+	if docs, _ := d.Get(Document{"email": "a"}); len(docs) != 1 {
+		t.Fatal("array values are supposed to be found through indexes", docs)
+	}
+	//2^53 and 2^53+1 are the same float64, an int64 index must still tell them apart
+	d.Table("big")
+	if err := d.EnsureUniqueIndex("n"); nil != err {
+		t.Fatal(err)
+	}
+	if err := d.Insert(Document{"n": int64(1 << 53)}); nil != err {
+		t.Fatal(err)
+	}
+	if err := d.Insert(Document{"n": int64(1<<53 + 1)}); nil != err {
+		t.Fatal("int64 values above 2^53 are supposed to have their own key", err)
+	}
+	if err := d.Insert(Document{"n": float64(1 << 53)}); !isDuplicateKey(err) {
+		t.Fatal("an integral float is supposed to share the key of the equal int", err)
+	}
+	if docs, _ := d.Get(Document{"n": int64(1<<53 + 1)}); len(docs) != 1 || docs[0]["n"] != int64(1<<53+1) {
+		t.Fatal("index lookup matched", docs)
+	}
+	if docs, _ := d.Get(Document{"n": Document{"$gt": int64(1 << 53)}}); len(docs) != 1 {
+		t.Fatal("range lookup matched", docs)
+	}
+	d.indexes = nil
+	if docs, _ := d.Get(Document{"n": int64(1 << 53)}); len(docs) != 1 {
+		t.Fatal("a scan is supposed to compare int64 values exactly", docs)
+	}
+	//values of different types are kept in the mongo order, a range on dates is not cut short by a bool
+	d.Table("mixed")
+	if err := d.EnsureIndex("v"); nil != err {
+		t.Fatal(err)
+	}
+	var t0 = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, v := range []interface{}{t0, false, t0.Add(2 * time.Hour), bson.ObjectId("aaaaaaaaaaaa"), nil, "s", 1, true} {
+		d.Insert(Document{"_id": i, "v": v})
+	}
+	if docs, _ := d.Get(Document{"v": Document{"$lt": t0.Add(3 * time.Hour)}}); len(docs) != 2 {
+		t.Fatal("$lt on dates is supposed to find both dates", docs)
+	}
+	if err := d.Remove(Document{"_id": 2}); nil != err {
+		t.Fatal(err)
+	}
+	if err := d.Remove(Document{"_id": 1}); nil != err {
+		t.Fatal(err)
+	}
+	if docs, _ := d.Get(Document{"v": Document{"$gte": t0}}); len(docs) != 1 || docs[0]["_id"] != 0 {
+		t.Fatal("removed documents are supposed to leave the index", docs)
+	}
+	for _, idx := range d.indexes["indexes"]["mixed"] {
+		for i := 1; i < len(idx.sorted); i++ {
+			if sortCompare(idx.sorted[i-1].value, idx.sorted[i].value) > 0 {
+				t.Fatal("the index is not sorted", idx.sorted)
+			}
+		}
+		if len(idx.sorted) != 6 {
+			t.Fatal("the index is supposed to keep 6 entries", idx.sorted)
+		}
+	}
+	d.indexes = nil
+}
+func Test_Errors(t *testing.T) {
+	d.store = make(map[string]map[string][]Document)
+	d.indexes = nil
+	d.Insert(Document{"num": 1})
+	if _, err := d.GetOne(Document{"num": 2}); !errors.Is(err, ErrNotFound) {
+		t.Fatal("GetOne is supposed to give ErrNotFound", err)
+	}
+	if docs, err := d.Get(Document{"num": 2}); nil != err || nil == docs || len(docs) != 0 {
+		t.Fatal("Get without a match is supposed to give an empty slice", docs, err)
+	}
+	if err := d.Remove(Document{"num": 2}); !errors.Is(err, ErrNotFound) {
+		t.Fatal("Remove is supposed to give ErrNotFound", err)
+	}
+	if _, err := d.Custom(nil); !errors.Is(err, ErrNotImplemented) {
+		t.Fatal("Custom is supposed to give ErrNotImplemented", err)
+	}
+	if _, err := new(mapDriver).Driver(); !errors.Is(err, ErrNoCollection) {
+		t.Fatal("Driver is supposed to give ErrNoCollection", err)
+	}
+	unnamed := newMapDriver()
+	unnamed.Insert(Document{"num": 1})
+	if n, err := unnamed.UpdateMultiWith(Document{}, NewUpdate().Set("num", 2)); nil != err || n != 1 {
+		t.Fatal("UpdateMultiWith is supposed to use the unnamed collection", n, err)
+	}
+	if docs, err := unnamed.AggregateMongo([]Document{{"$match": Document{"num": 2}}}); nil != err || len(docs) != 1 {
+		t.Fatal("AggregateMongo is supposed to use the unnamed collection", docs, err)
+	}
+	if n, err := unnamed.RemoveMulti(Document{}); nil != err || n != 1 {
+		t.Fatal("RemoveMulti is supposed to use the unnamed collection", n, err)
+	}
+	d.EnsureUniqueIndex("num")
+	if err := d.Insert(Document{"num": 1}); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatal("Insert is supposed to give ErrDuplicateKey", err)
+	}
+	d.indexes = nil
+}
+func Test_Context(t *testing.T) {
+	d.store = make(map[string]map[string][]Document)
+	for i := 0; i < 100; i++ {
+		d.Insert(Document{"num": i})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if docs, err := d.GetCtx(ctx, d.Lt(Document{"num": 10})); nil != err || len(docs) != 10 {
+		t.Fatal("GetCtx is wrong", err)
+	}
+	cancel()
+	if _, err := d.GetCtx(ctx, Document{}); !errors.Is(err, context.Canceled) {
+		t.Fatal("GetCtx is supposed to stop once the context is cancelled", err)
+	}
+	if err := d.InsertCtx(ctx, Document{"num": 100}); !errors.Is(err, context.Canceled) {
+		t.Fatal("InsertCtx is supposed to stop once the context is cancelled", err)
+	}
+	if err := d.UpdateCtx(ctx, Document{"num": 1}, Document{"num": 1000}); !errors.Is(err, context.Canceled) {
+		t.Fatal("UpdateCtx is supposed to stop once the context is cancelled", err)
+	}
+	if err := d.RemoveCtx(ctx, Document{"num": 1}); !errors.Is(err, context.Canceled) {
+		t.Fatal("RemoveCtx is supposed to stop once the context is cancelled", err)
+	}
+	errs := d.InsertMultiNoFailCtx(ctx, []Document{{"num": 101}, {"num": 102}})
+	if len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+		t.Fatal("InsertMultiNoFailCtx is supposed to stop at the first document", errs)
+	}
+	if docs, _ := d.Get(Document{}); len(docs) != 100 {
+		t.Fatal("cancelled calls must not change the documents", len(docs))
+	}
+}
+
+func Test_Open(t *testing.T) {
+	m, err := Open("mem:///db/col")
+	if nil != err {
+		t.Fatal(err)
+	}
+	drv, err := m.Driver()
+	if nil != err {
+		t.Fatal("the path is supposed to select db and collection", err)
+	}
+	drv.Insert(Document{"a": 1})
+	if md := m.(*mapDriver); md.database != "db" || md.collection != "col" || len(md.store["db"]["col"]) != 1 {
+		t.Fatal("wrong db or collection", md.database, md.collection)
+	}
+	m, err = Open("MEM:///db")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err := m.Driver(); !errors.Is(err, ErrNoCollection) {
+		t.Fatal("only the db is supposed to be set", err)
+	}
+	dir := t.TempDir()
+	m, err = Open("mem:///db/col?snapshot=0&dir=" + dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if nil == m.(*mapDriver).persist {
+		t.Fatal("dir is supposed to open a persistent driver")
+	}
+	for _, u := range []string{"nosuch:///db/col", "mem://host/db", "mem:///a/b/c", "mem:///db?snapshot=x"} {
+		if _, err := Open(u); nil == err {
+			t.Error(u, "is supposed to fail")
+		}
+	}
+	var schemes = Drivers()
+	if len(schemes) < 2 || schemes[0] != "mem" || schemes[1] != "mongodb" {
+		t.Fatal("unexpected drivers", schemes)
+	}
+	func() {
+		defer func() {
+			if nil == recover() {
+				t.Fatal("registering a scheme twice is supposed to panic")
+			}
+		}()
+		Register("mem", func(*url.URL) (Meta, error) { return nil, nil })
+	}()
+	registerFailing.Do(func() {
+		Register("test-failing", func(*url.URL) (Meta, error) {
+			failing = &tableFailingMeta{mapDriver: newMapDriver()}
+			return failing, nil
+		})
+	})
+	if _, err := Open("test-failing:///db/col"); nil == err || !failing.closed {
+		t.Fatal("a driver whose Table fails is supposed to be closed", err)
+	}
+}
+
+var (
+	registerFailing sync.Once
+	failing         *tableFailingMeta
+)
+
+//tableFailingMeta records whether Open closed it after its Table failed
+type tableFailingMeta struct {
+	*mapDriver
+	closed bool
+}
+
+func (m *tableFailingMeta) Table(string) error {
+	return errors.New("no such table")
+}
+func (m *tableFailingMeta) Close() error {
+	m.closed = true
+	return m.mapDriver.Close()
+}
+
+func Test_Lifecycle(t *testing.T) {
+	var mem = NewMapDriver()
+	if err := mem.Ping(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	if report := mem.Health(); !report.Healthy || report.Driver != "map" || report.CheckedAt.IsZero() {
+		t.Fatal("unexpected report", report)
+	}
+	if err := mem.Close(); nil != err {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := mem.Ping(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatal("Ping is supposed to respect ctx", err)
+	}
+
+	dir := t.TempDir()
+	m, err := openMapDriver(dir, SnapshotInterval(time.Hour))
+	if nil != err {
+		t.Fatal(err)
+	}
+	m.DB("life")
+	m.Table("docs")
+	p, _ := m.Driver()
+	p.Insert(Document{"num": 1})
+	if err := m.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if err := m.Close(); nil != err {
+		t.Fatal("a second Close is supposed to be a no-op", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, mapWALFile)); nil != err || info.Size() != 0 {
+		t.Fatal("Close is supposed to snapshot", err)
+	}
+	if err := p.Insert(Document{"num": 2}); !errors.Is(err, ErrClosed) {
+		t.Fatal("writes after Close are supposed to give ErrClosed", err)
+	}
+	if err := m.Ping(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatal("Ping is supposed to give ErrClosed", err)
+	}
+	if report := m.Health(); report.Healthy || !errors.Is(report.Err, ErrClosed) {
+		t.Fatal("a closed driver is not healthy", report)
+	}
+	reopened, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	reopened.DB("life")
+	reopened.Table("docs")
+	p, _ = reopened.Driver()
+	if docs, _ := p.Get(Document{}); len(docs) != 1 {
+		t.Fatal("wrong documents after reopening", docs)
+	}
+	reopened.Close()
+}
+
+func Test_UpdateWith(t *testing.T) {
+	if _, err := NewUpdate().Set("a", 1).Unset("a.b").Document(); nil == err {
+		t.Fatal("a field and its sub field are supposed to conflict")
+	}
+	if _, err := NewUpdate().Rename("a", "b").Set("b", 1).Document(); nil == err {
+		t.Fatal("the target of a rename is supposed to conflict")
+	}
+	doc, err := NewUpdate().Push("t", 1).Push("t", 2).Set("a", 1).Document()
+	if nil != err || !reflect.DeepEqual(doc, Document{"$push": Document{"t": Document{"$each": []interface{}{1, 2}}}, "$set": Document{"a": 1}}) {
+		t.Fatal("unexpected update document", doc, err)
+	}
+
+	dir := t.TempDir()
+	m, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	m.DB("db")
+	m.Table("col")
+	m.EnsureUniqueIndex("email")
+	p, _ := m.Driver()
+	p.Insert(Document{"email": "a", "n": 1})
+	p.Insert(Document{"email": "b", "n": 1})
+	if _, err := p.UpdateMultiWith(Document{"n": 1}, NewUpdate().Set("email", "c")); !isDuplicateKey(err) {
+		t.Fatal("the unique index is supposed to reject the update", err)
+	}
+	if docs, _ := p.Get(Document{"email": "c"}); len(docs) != 0 {
+		t.Fatal("a rejected update is not supposed to change any document", docs)
+	}
+	if _, err := p.UpdateMultiWith(Document{"n": 1}, NewUpdate().Inc("n", 1).CurrentDate("at")); nil != err {
+		t.Fatal(err)
+	}
+	before, _ := p.GetOne(Document{"email": "a"})
+	p.SaveWith(Document{"email": "d"}, NewUpdate().Push("tags", "x"))
+	m.Close()
+
+	reopened, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	reopened.DB("db")
+	reopened.Table("col")
+	p, _ = reopened.Driver()
+	after, err := p.GetOne(Document{"email": "a"})
+	if nil != err || after["n"] != 2 || !after["at"].(time.Time).Equal(before["at"].(time.Time)) {
+		t.Fatal("the update is not replayed the same way", before, after, err)
+	}
+	if doc, err := p.GetOne(Document{"email": "d"}); nil != err || len(toSlice(doc["tags"])) != 1 {
+		t.Fatal("the upsert is not persisted", doc, err)
+	}
+}
+
+func Test_Arithmetic(t *testing.T) {
+	d.store = make(map[string]map[string][]Document)
+	d.indexes = nil
+	d.DB("db")
+	d.Table("arithmetic")
+	d.Insert(Document{"_id": 1, "big": int64(1<<53 + 1), "small": int32(7), "max": int64(math.MaxInt64)})
+	if err := d.UpdateWith(Document{"_id": 1}, NewUpdate().Inc("big", 2).Inc("small", int32(1)).Inc("missing", int32(3)).Mul("zero", int32(5))); nil != err {
+		t.Fatal(err)
+	}
+	doc, _ := d.GetOne(Document{"_id": 1})
+	if doc["big"] != int64(1<<53+3) || doc["small"] != int32(8) || doc["missing"] != int32(3) || doc["zero"] != int32(0) {
+		t.Fatal("integers are supposed to stay exact and keep their type", doc)
+	}
+	if err := d.UpdateWith(Document{"_id": 1}, NewUpdate().Inc("small", int32(math.MaxInt32))); nil != err {
+		t.Fatal(err)
+	}
+	if doc, _ := d.GetOne(Document{"_id": 1}); doc["small"] != int64(math.MaxInt32)+8 {
+		t.Fatal("an int32 is supposed to grow into an int64", doc["small"])
+	}
+	if err := d.UpdateWith(Document{"_id": 1}, NewUpdate().Mul("max", 2)); nil == err {
+		t.Fatal("an int64 overflow is supposed to be an error")
+	}
+	res, err := d.AggregateMongo([]Document{{"$group": Document{"_id": nil, "sum": Document{"$sum": "$big"}}}})
+	if nil != err || len(res) != 1 || res[0]["sum"] != int64(1<<53+3) {
+		t.Fatal("$sum is supposed to add integers exactly", res, err)
+	}
+
+	var u = NewUpdate().Push("tags", "a")
+	change, _ := u.Document()
+	u.Push("tags", "b")
+	if each := change["$push"].(Document)["tags"].(Document)["$each"].([]interface{}); len(each) != 1 {
+		t.Fatal("Document is supposed to return a copy", each)
+	}
+}
+
+func Test_FindAndModify(t *testing.T) {
+	dir := t.TempDir()
+	m, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	m.DB("db")
+	m.Table("queue")
+	p, _ := m.Driver()
+	for i := 0; i < 5; i++ {
+		p.Insert(Document{"job": i, "priority": i % 2, "state": "new"})
+	}
+	var take = NewUpdate().Set("state", "taken")
+	job, err := p.FindAndUpdate(Document{"state": "new"}, take, FindAndUpdateOptions{Sort: []string{"-priority", "-job"}, ReturnNew: true})
+	if nil != err || job["job"] != 3 || job["state"] != "taken" {
+		t.Fatal("the sort is supposed to pick the job", job, err)
+	}
+	job["state"] = "changed"
+	if stored, _ := p.GetOne(Document{"job": 3}); stored["state"] != "taken" {
+		t.Fatal("the returned document is not supposed to alias the stored one")
+	}
+	p.FindAndUpdate(Document{"state": "new"}, take, FindAndUpdateOptions{Sort: []string{"-priority", "-job"}})
+	removed, err := p.FindAndRemove(Document{"state": "new"})
+	if nil != err || removed["job"] != 0 {
+		t.Fatal("FindAndRemove is supposed to take the first match", removed, err)
+	}
+	m.Close()
+
+	reopened, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	reopened.DB("db")
+	reopened.Table("queue")
+	p, _ = reopened.Driver()
+	if docs, _ := p.Get(Document{"state": "taken"}); len(docs) != 2 || docs[0]["job"] != 1 || docs[1]["job"] != 3 {
+		t.Fatal("the replay is supposed to pick the same jobs", docs)
+	}
+	if docs, _ := p.Get(Document{}); len(docs) != 4 {
+		t.Fatal("the removal is not replayed", docs)
+	}
+}
+
+func Test_RemoveMulti(t *testing.T) {
+	dir := t.TempDir()
+	m, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	m.DB("db")
+	m.Table("col")
+	m.EnsureUniqueIndex("num")
+	p, _ := m.Driver()
+	for i := 0; i < 10; i++ {
+		p.Insert(Document{"num": i, "even": i%2 == 0})
+	}
+	if n, err := p.RemoveMulti(Document{"even": true}); nil != err || n != 5 {
+		t.Fatal("RemoveMulti removed", n, err)
+	}
+	if err := p.Insert(Document{"num": 4}); nil != err {
+		t.Fatal("the index still holds a removed document", err)
+	}
+	m.Close()
+	reopened, err := openMapDriver(dir, SnapshotInterval(0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	reopened.DB("db")
+	reopened.Table("col")
+	p, _ = reopened.Driver()
+	if docs, _ := p.Get(Document{}); len(docs) != 6 {
+		t.Fatal("RemoveMulti is not replayed", docs)
+	}
+}
+
+type codecAddress struct {
+	City string
+	Zip  string `bson:"zip,omitempty"`
+}
+type codecBase struct {
+	Created time.Time `bson:"created"`
+}
+type codecUser struct {
+	ID        string `bson:"_id,omitempty"`
+	Name      string `bson:"full_name"`
+	Age       int
+	Secret    string `bson:"-"`
+	Address   codecAddress
+	Tags      []string
+	Manager   *codecUser             `bson:",omitempty"`
+	Extra     map[string]interface{} `bson:",inline"`
+	codecBase `bson:",inline"`
+}
+
+func Test_ProjectPath(t *testing.T) {
+	doc := Document{"items": []interface{}{1, Document{"qty": 2, "sku": "x"}}, "address": Document{"city": "Izmir", "zip": "35"}}
+	original := copyDocument(doc)
+	if p := projectDocument(doc, []string{"items", "items.qty", "address", "address.city"}); !reflect.DeepEqual(p, original) {
+		t.Fatal("a field projected whole is supposed to cover the paths under it", p)
+	}
+	p := projectDocument(doc, []string{"items.qty", "items.sku", "address.city"})
+	if !reflect.DeepEqual(p, Document{"items": []interface{}{Document{"qty": 2, "sku": "x"}}, "address": Document{"city": "Izmir"}}) {
+		t.Fatal("paths of the same array are supposed to be merged", p)
+	}
+	p["items"].([]interface{})[0].(Document)["qty"] = 3
+	if !reflect.DeepEqual(doc, original) {
+		t.Fatal("projecting changed the document", doc)
+	}
+}
+func Test_Codec(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	user := codecUser{
+		Name:      "Ali",
+		Age:       30,
+		Secret:    "x",
+		Address:   codecAddress{City: "Izmir"},
+		Tags:      []string{"a", "b"},
+		Extra:     map[string]interface{}{"score": 5},
+		codecBase: codecBase{Created: created},
+	}
+	doc, err := ToDocument(&user)
+	if nil != err {
+		t.Fatal(err)
+	}
+	expected := Document{
+		"full_name": "Ali",
+		"age":       30,
+		"address":   Document{"city": "Izmir"},
+		"tags":      []interface{}{"a", "b"},
+		"score":     5,
+		"created":   created.Local(),
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatal("unexpected document", doc)
+	}
+	doc["_id"] = "u1"
+	doc["age"] = int64(30)
+	doc["manager"] = Document{"full_name": "Veli", "age": 50.0}
+	var decoded codecUser
+	if err := FromDocument(doc, &decoded); nil != err {
+		t.Fatal(err)
+	}
+	user.ID, user.Secret = "u1", ""
+	user.Manager = &codecUser{Name: "Veli", Age: 50}
+	user.Created = created.Local()
+	if !reflect.DeepEqual(decoded, user) {
+		t.Fatalf("unexpected struct %+v", decoded)
+	}
+	var users []codecUser
+	if err := DecodeDocuments([]Document{doc, {"full_name": "Deniz"}}, &users); nil != err || len(users) != 2 || users[1].Name != "Deniz" {
+		t.Fatal("DecodeDocuments failed", users, err)
+	}
+	if err := FromDocument(Document{"age": 1.5}, &decoded); nil != err || decoded.Age != 1 || decoded.Name != "" {
+		t.Fatal("a fraction is supposed to be truncated into an int on a reset struct like mgo does", decoded, err)
+	}
+	if err := FromDocument(Document{"age": "old"}, &decoded); nil != err || decoded.Age != 0 {
+		t.Fatal("a string is supposed to be skipped for an int like mgo does", decoded, err)
+	}
+	var fromCursor []codecUser
+	d.store = make(map[string]map[string][]Document)
+	d.DB("codec")
+	d.Table("users")
+	d.Insert(doc)
+	if err := d.Cursor().All(&fromCursor); nil != err || !reflect.DeepEqual(fromCursor, users[:1]) {
+		t.Fatal("Cursor.All and DecodeDocuments are supposed to decode alike", fromCursor, err)
+	}
+	if doc, err := ToDocument(map[string]interface{}(nil)); nil != err || len(doc) != 0 || nil == doc {
+		t.Fatal("a nil map is supposed to give an empty document", doc, err)
+	}
+	if _, err := ToDocument((*codecUser)(nil)); nil == err {
+		t.Fatal("a nil pointer is not supposed to be a document")
+	}
+	if err := FromDocument(doc, decoded); nil == err {
+		t.Fatal("decoding is supposed to need a pointer")
+	}
+	if _, err := ToDocument(5); nil == err {
+		t.Fatal("a number is not supposed to be a document")
+	}
+	if _, err := ToDocument(struct {
+		A string `bson:"a"`
+		B string `bson:"a"`
+	}{}); nil == err {
+		t.Fatal("a key used twice is supposed to fail")
+	}
+}
+
+//Test_Race is meant to be run with go test -race, clones work on shared collections while snapshots are written
+func Test_Race(t *testing.T) {
+	meta, err := openMapDriver(t.TempDir(), SnapshotInterval(time.Millisecond))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer meta.Close()
+	if clone := meta.Clone().(*mapDriver); clone.mu != meta.(*mapDriver).mu {
+		t.Fatal("clones are supposed to share the lock of the store")
+	}
+	var collection = func(i int) StorageDriver {
+		m := meta.Clone()
+		m.DB("race")
+		m.Table("col" + strconv.Itoa(i%2))
+		drv, _ := m.Driver()
+		return drv
+	}
+	for i := 0; i < 2; i++ {
+		if err := collection(i).Insert(Document{"_id": "counter", "n": 0}); nil != err {
+			t.Fatal(err)
+		}
+	}
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			drv := collection(w)
+			for i := 0; i < rounds; i++ {
+				drv.Insert(Document{"worker": w, "num": i})
+				drv.UpdateWith(Document{"_id": "counter"}, NewUpdate().Inc("n", 1))
+				drv.Save(Document{"key": "shared"}, Document{"by": w})
+				drv.Get(Document{"worker": w})
+				drv.Find(Gte("num", i))
+				drv.FindAndUpdate(Document{"worker": w, "num": i}, NewUpdate().Set("seen", true), FindAndUpdateOptions{})
+				var n int
+				drv.Cursor().Sort("-num").Count(&n)
+				drv.AggregateMongo([]Document{{"$match": Document{"worker": w}}, {"$count": "n"}})
+				drv.RemoveMulti(Document{"worker": w, "num": Document{"$lt": i - 10}})
+				if i == rounds/2 {
+					drv.(Meta).EnsureIndex("worker", "num")
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for i := 0; i < 2; i++ {
+		drv := collection(i)
+		if counter, err := drv.GetOne(Document{"_id": "counter"}); nil != err || counter["n"] != workers/2*rounds {
+			t.Fatal("increments are supposed to be atomic", counter, err)
+		}
+		if docs, err := drv.Get(Document{"key": "shared"}); nil != err || len(docs) != 1 {
+			t.Fatal("concurrent saves of the same key are supposed to insert a single document", len(docs), err)
+		}
+		for w := i; w < workers; w += 2 {
+			if docs, err := drv.Get(Document{"worker": w}); nil != err || len(docs) != 11 {
+				t.Fatal("worker", w, "is supposed to have 11 documents left", len(docs), err)
+			}
+		}
+	}
+}
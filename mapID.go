@@ -0,0 +1,81 @@
+package storageDriver
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (d *mapDriver) InsertWithID(doc Document) (interface{}, error) {
+	return d.InsertWithIDCtx(context.Background(), doc)
+}
+func (d *mapDriver) InsertWithIDCtx(ctx context.Context, doc Document) (interface{}, error) {
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	doc = d.copyDocument(doc)
+	if err := d.insert(doc); nil != err {
+		return nil, err
+	}
+	return doc["_id"], nil
+}
+
+//setID gives doc an ObjectId _id like mongodb does when it has none
+func setID(doc Document) {
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = bson.NewObjectId()
+	}
+}
+
+//idCheck rejects a change of the _id between the stored doc and its updated version
+func idCheck(doc, updated Document) error {
+	old, had := doc["_id"]
+	id, has := updated["_id"]
+	if had != has || !equalValues(old, id) {
+		return ErrImmutableID
+	}
+	return nil
+}
+
+//idQuery selects docs by their _id. The log keeps it instead of the query of a write so a replay changes the very
+//same documents, the order plan returns matches in may differ once the indexes are rebuilt from a snapshot
+func idQuery(docs ...Document) Document {
+	var ids = make([]interface{}, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc["_id"]
+	}
+	return Document{"_id": Document{"$in": ids}}
+}
+
+func isIDIndex(idx *mapIndex) bool {
+	return len(idx.fields) == 1 && idx.fields[0] == "_id"
+}
+
+//ensureIDIndex creates the unique _id index every collection has, first in line so plan looks up _id in O(1).
+//It is implicit, never logged nor persisted, the caller holds the lock. It reports whether documents were given an _id
+func (d *mapDriver) ensureIDIndex() bool {
+	for _, idx := range d.indexes[d.database][d.collection] {
+		if isIDIndex(idx) {
+			return false
+		}
+	}
+	idx := newMapIndex([]string{"_id"}, true)
+	var gaveIDs bool
+	for _, doc := range d.store[d.database][d.collection] {
+		if _, ok := doc["_id"]; !ok {
+			gaveIDs = true
+		}
+		setID(doc)
+		idx.add(doc)
+	}
+	if nil == d.indexes {
+		d.indexes = make(map[string]map[string][]*mapIndex)
+	}
+	if nil == d.indexes[d.database] {
+		d.indexes[d.database] = make(map[string][]*mapIndex)
+	}
+	d.indexes[d.database][d.collection] = append([]*mapIndex{idx}, d.indexes[d.database][d.collection]...)
+	return gaveIDs
+}
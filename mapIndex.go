@@ -0,0 +1,401 @@
+package storageDriver
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+//mapIndex keeps a hash of the indexed values for equality lookups and a slice sorted on the first field for ranges.
+//Documents whose indexed values are arrays or documents cannot be hashed, they are kept in overflow and always scanned
+type mapIndex struct {
+	fields   []string
+	unique   bool
+	hash     map[string][]Document
+	sorted   []mapIndexEntry
+	overflow []Document
+}
+
+type mapIndexEntry struct {
+	value interface{}
+	doc   Document
+}
+
+type mapIndexSpec struct {
+	Fields []string `bson:"fields"`
+	Unique bool     `bson:"unique"`
+}
+
+func (d *mapDriver) EnsureIndex(fields ...string) error {
+	return d.ensureIndex(fields, false)
+}
+
+func (d *mapDriver) EnsureUniqueIndex(fields ...string) error {
+	return d.ensureIndex(fields, true)
+}
+
+func (d *mapDriver) ensureIndex(fields []string, unique bool) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("an index needs at least one field")
+	}
+	var names = make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = strings.TrimLeft(field, "+-")
+		if names[i] == "" {
+			return fmt.Errorf("empty index field")
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(names) == 1 && names[0] == "_id" {
+		d.ensureIDIndex()
+		return nil
+	}
+	for _, idx := range d.indexes[d.database][d.collection] {
+		if reflect.DeepEqual(idx.fields, names) {
+			if idx.unique != unique {
+				return fmt.Errorf("an index on %s already exists with different options", strings.Join(names, ", "))
+			}
+			return nil
+		}
+	}
+	idx := newMapIndex(names, unique)
+	for _, doc := range d.store[d.database][d.collection] {
+		if err := idx.check(doc, nil); nil != err {
+			return err
+		}
+		idx.add(doc)
+	}
+	if err := d.log("ensureIndex", nil, Document{"fields": names, "unique": unique}); nil != err {
+		return err
+	}
+	if nil == d.indexes {
+		d.indexes = make(map[string]map[string][]*mapIndex)
+	}
+	if nil == d.indexes[d.database] {
+		d.indexes[d.database] = make(map[string][]*mapIndex)
+	}
+	d.indexes[d.database][d.collection] = append(d.indexes[d.database][d.collection], idx)
+	return nil
+}
+
+//indexSpecs lists the index definitions of every collection so they can be persisted, the _id index is always rebuilt
+func (d *mapDriver) indexSpecs() map[string]map[string][]mapIndexSpec {
+	var specs = make(map[string]map[string][]mapIndexSpec)
+	for db, cols := range d.indexes {
+		specs[db] = make(map[string][]mapIndexSpec)
+		for col, indexes := range cols {
+			for _, idx := range indexes {
+				if isIDIndex(idx) {
+					continue
+				}
+				specs[db][col] = append(specs[db][col], mapIndexSpec{Fields: idx.fields, Unique: idx.unique})
+			}
+		}
+	}
+	return specs
+}
+
+//indexCheck verifies doc against every unique index of the current collection, self is the stored version of doc if any
+func (d *mapDriver) indexCheck(doc, self Document) error {
+	for _, idx := range d.indexes[d.database][d.collection] {
+		if err := idx.check(doc, self); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+//indexCheckBatch verifies that documents written together do not duplicate each other on a unique index
+func (d *mapDriver) indexCheckBatch(docs []Document) error {
+	for _, idx := range d.indexes[d.database][d.collection] {
+		if !idx.unique {
+			continue
+		}
+		var seen = make(map[string]bool, len(docs))
+		for _, doc := range docs {
+			values, key, ok := idx.key(doc)
+			if !ok {
+				continue
+			}
+			if seen[key] {
+				return &DuplicateKeyError{Index: idx.fields, Key: values}
+			}
+			seen[key] = true
+		}
+	}
+	return nil
+}
+
+func (d *mapDriver) indexAdd(doc Document) {
+	for _, idx := range d.indexes[d.database][d.collection] {
+		idx.add(doc)
+	}
+}
+
+func (d *mapDriver) indexRemove(doc Document) {
+	for _, idx := range d.indexes[d.database][d.collection] {
+		idx.remove(doc)
+	}
+}
+
+//plan returns the documents of the current collection worth checking against query.
+//An index is used when it covers equality or range conditions of the query, otherwise the whole collection is returned
+func (d *mapDriver) plan(query Document) []Document {
+	docs := d.store[d.database][d.collection]
+	indexes := d.indexes[d.database][d.collection]
+	if len(indexes) == 0 || len(query) == 0 {
+		return docs
+	}
+	for _, idx := range indexes {
+		if candidates, ok := idx.lookup(query); ok {
+			return candidates
+		}
+	}
+	for _, idx := range indexes {
+		if candidates, ok := idx.scanRange(query); ok {
+			return candidates
+		}
+	}
+	return docs
+}
+
+func newMapIndex(fields []string, unique bool) *mapIndex {
+	return &mapIndex{
+		fields: fields,
+		unique: unique,
+		hash:   make(map[string][]Document),
+	}
+}
+
+//key returns the hash key of doc and false when one of the values cannot be hashed
+func (idx *mapIndex) key(doc Document) ([]interface{}, string, bool) {
+	var values = make([]interface{}, len(idx.fields))
+	var parts = make([]string, len(idx.fields))
+	for i, field := range idx.fields {
+		values[i], _ = lookupPath(doc, field)
+		part, ok := indexValueKey(values[i])
+		if !ok {
+			return values, "", false
+		}
+		parts[i] = part
+	}
+	return values, strings.Join(parts, "\x00"), true
+}
+
+func (idx *mapIndex) check(doc, self Document) error {
+	if !idx.unique {
+		return nil
+	}
+	values, key, ok := idx.key(doc)
+	if !ok {
+		return nil
+	}
+	for _, other := range idx.hash[key] {
+		if !sameDocument(other, self) {
+			return &DuplicateKeyError{Index: idx.fields, Key: values}
+		}
+	}
+	return nil
+}
+
+func (idx *mapIndex) add(doc Document) {
+	values, key, ok := idx.key(doc)
+	if !ok {
+		idx.overflow = append(idx.overflow, doc)
+		return
+	}
+	idx.hash[key] = append(idx.hash[key], doc)
+	i := sort.Search(len(idx.sorted), func(i int) bool { return sortCompare(idx.sorted[i].value, values[0]) > 0 })
+	idx.sorted = append(idx.sorted, mapIndexEntry{})
+	copy(idx.sorted[i+1:], idx.sorted[i:])
+	idx.sorted[i] = mapIndexEntry{value: values[0], doc: doc}
+}
+
+func (idx *mapIndex) remove(doc Document) {
+	values, key, ok := idx.key(doc)
+	if !ok {
+		idx.overflow = removeDocument(idx.overflow, doc)
+		return
+	}
+	if bucket := removeDocument(idx.hash[key], doc); len(bucket) > 0 {
+		idx.hash[key] = bucket
+	} else {
+		delete(idx.hash, key)
+	}
+	i := sort.Search(len(idx.sorted), func(i int) bool { return sortCompare(idx.sorted[i].value, values[0]) >= 0 })
+	for ; i < len(idx.sorted); i++ {
+		if sameDocument(idx.sorted[i].doc, doc) {
+			idx.sorted = append(idx.sorted[:i], idx.sorted[i+1:]...)
+			return
+		}
+	}
+}
+
+//lookup serves queries with an equality or $in condition on every indexed field
+func (idx *mapIndex) lookup(query Document) ([]Document, bool) {
+	var keys = []string{""}
+	for i, field := range idx.fields {
+		cond, present := query[field]
+		if !present {
+			return nil, false
+		}
+		values, ok := equalityValues(cond)
+		if !ok {
+			return nil, false
+		}
+		var next = make([]string, 0, len(keys)*len(values))
+		for _, prefix := range keys {
+			for _, v := range values {
+				part, ok := indexValueKey(v)
+				if !ok {
+					return nil, false
+				}
+				if i > 0 {
+					part = prefix + "\x00" + part
+				}
+				next = append(next, part)
+			}
+		}
+		keys = next
+	}
+	var seen = make(map[string]bool, len(keys))
+	var docs = make([]Document, 0)
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			docs = append(docs, idx.hash[key]...)
+		}
+	}
+	return append(docs, idx.overflow...), true
+}
+
+//scanRange serves $gt, $gte, $lt and $lte conditions on the first indexed field
+func (idx *mapIndex) scanRange(query Document) ([]Document, bool) {
+	cond, ok := toDocument(query[idx.fields[0]])
+	if !ok || !isOperatorDocument(cond) {
+		return nil, false
+	}
+	lo, hi := 0, len(idx.sorted)
+	var ranged bool
+	for op, arg := range cond {
+		if _, ok := indexValueKey(arg); !ok || nil == arg {
+			continue
+		}
+		switch op {
+		case "$gt", "$gte":
+			strict := op == "$gt"
+			i := sort.Search(len(idx.sorted), func(i int) bool {
+				c := sortCompare(idx.sorted[i].value, arg)
+				return c > 0 || (!strict && c == 0)
+			})
+			if i > lo {
+				lo = i
+			}
+		case "$lt", "$lte":
+			strict := op == "$lt"
+			i := sort.Search(len(idx.sorted), func(i int) bool {
+				c := sortCompare(idx.sorted[i].value, arg)
+				return c > 0 || (strict && c == 0)
+			})
+			if i < hi {
+				hi = i
+			}
+		default:
+			continue
+		}
+		ranged = true
+	}
+	if !ranged {
+		return nil, false
+	}
+	var docs = make([]Document, 0)
+	for i := lo; i < hi; i++ {
+		docs = append(docs, idx.sorted[i].doc)
+	}
+	return append(docs, idx.overflow...), true
+}
+
+//equalityValues returns the values a condition can be equal to, false when it is not an equality condition
+func equalityValues(cond interface{}) ([]interface{}, bool) {
+	ops, ok := toDocument(cond)
+	if !ok {
+		if nil != toSlice(cond) {
+			return nil, false
+		}
+		return []interface{}{cond}, true
+	}
+	if len(ops) != 1 {
+		return nil, false
+	}
+	if v, ok := ops["$eq"]; ok {
+		return equalityValues(v)
+	}
+	if v, ok := ops["$in"]; ok {
+		values := toSlice(v)
+		return values, nil != values
+	}
+	return nil, false
+}
+
+//indexValueKey encodes scalars so that values equal for the matcher share a key, 1 and 1.0 for example
+func indexValueKey(v interface{}) (string, bool) {
+	if n, ok := numberKey(v); ok {
+		return "n:" + n, true
+	}
+	switch val := v.(type) {
+	case nil:
+		return "z:", true
+	case string:
+		return "s:" + val, true
+	case bool:
+		return "b:" + strconv.FormatBool(val), true
+	case time.Time:
+		return "t:" + strconv.FormatInt(val.UnixNano(), 10), true
+	case bson.ObjectId:
+		return "o:" + string(val), true
+	}
+	return "", false
+}
+
+//numberKey writes integers and integral floats as exact integers so that int64 values beyond 2^53 keep their own key
+func numberKey(v interface{}) (string, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		switch {
+		case f != math.Trunc(f):
+		case f >= -(1<<63) && f < 1<<63:
+			return strconv.FormatInt(int64(f), 10), true
+		case f >= 0 && f < 1<<64:
+			return strconv.FormatUint(uint64(f), 10), true
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), true
+	}
+	return "", false
+}
+
+//sameDocument compares the identity of two stored documents, not their contents
+func sameDocument(a, b Document) bool {
+	return nil != a && nil != b && reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+func removeDocument(docs []Document, doc Document) []Document {
+	for i, other := range docs {
+		if sameDocument(other, doc) {
+			return append(docs[:i], docs[i+1:]...)
+		}
+	}
+	return docs
+}
@@ -0,0 +1,404 @@
+package storageDriver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	mapSnapshotFile = "snapshot.bson"
+	mapWALFile      = "wal.bson"
+	//mapWALMaxRecord bounds the length a record header may claim, a longer one is corruption. It leaves room for
+	//a query and a document of the 16MB mongodb allows
+	mapWALMaxRecord = 48 << 20
+	//DefaultSnapshotInterval is how often a persistent map driver snapshots its state unless SnapshotInterval is given
+	DefaultSnapshotInterval = time.Minute
+)
+
+//MapOption configures a map driver created by NewMapDriver
+type MapOption func(*mapDriver)
+
+//WithPersistence keeps the data of the map driver in dir.
+//Every write is appended to a write-ahead log before it is applied,
+//snapshots are written on a schedule and the state is rebuilt from both when the driver is created again.
+//When dir cannot be opened or its data cannot be loaded the driver is empty, Ping reports the error and writes fail with it
+func WithPersistence(dir string) MapOption {
+	return func(d *mapDriver) {
+		d.persistDir = dir
+	}
+}
+
+//SnapshotInterval sets how often a persistent map driver writes a snapshot and truncates its write-ahead log.
+//A zero or negative interval disables scheduled snapshots
+func SnapshotInterval(interval time.Duration) MapOption {
+	return func(d *mapDriver) {
+		d.snapshotInterval = interval
+	}
+}
+
+//SyncWAL makes every write of a persistent map driver wait until its log record is on disk.
+//Without it a write survives a crash of the process but not always one of the machine
+func SyncWAL(sync bool) MapOption {
+	return func(d *mapDriver) {
+		d.syncWAL = sync
+	}
+}
+
+type mapPersistence struct {
+	dir  string
+	wal  *os.File
+	sync bool
+	//offset is where the last complete record of the log ends, seq is the sequence number of that record
+	offset int64
+	seq    int64
+	stop   chan struct{}
+	err    error
+	closed bool
+	//failed is the error the persistence could not be opened with
+	failed error
+}
+
+//walRecord is numbered with Seq so a replay skips the records a snapshot holds already,
+//the log may outlive a snapshot when the process stops before truncating it
+type walRecord struct {
+	Seq   int64    `bson:"seq,omitempty"`
+	Op    string   `bson:"op"`
+	DB    string   `bson:"db"`
+	Table string   `bson:"table"`
+	Query Document `bson:"query,omitempty"`
+	Doc   Document `bson:"doc,omitempty"`
+}
+
+type mapSnapshot struct {
+	Seq     int64                                `bson:"seq,omitempty"`
+	Store   map[string]map[string][]Document     `bson:"store"`
+	Indexes map[string]map[string][]mapIndexSpec `bson:"indexes,omitempty"`
+}
+
+//openPersistence rebuilds the state from the snapshot and the log in dir. When it fails the driver is left
+//empty with a persistence that refuses writes, NewMapDriver has no error to return
+func (d *mapDriver) openPersistence(dir string) {
+	if err := d.loadPersistence(dir); nil != err {
+		d.store = make(map[string]map[string][]Document)
+		d.indexes = nil
+		d.persist = &mapPersistence{dir: dir, closed: true, failed: err}
+	}
+	d.database, d.collection = "", ""
+}
+
+func (d *mapDriver) loadPersistence(dir string) error {
+	if err := os.MkdirAll(dir, 0755); nil != err {
+		return err
+	}
+	var p = &mapPersistence{dir: dir, sync: d.syncWAL, stop: make(chan struct{})}
+	snapshotIDs, err := d.loadSnapshot(p, filepath.Join(dir, mapSnapshotFile))
+	if nil != err {
+		return err
+	}
+	walIDs, err := d.replayWAL(p, filepath.Join(dir, mapWALFile))
+	if nil != err {
+		return err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, mapWALFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if nil != err {
+		return err
+	}
+	p.wal = wal
+	//documents written before every document had an _id were given a random one while loading,
+	//the log refers to documents by _id so they are kept in a snapshot right away
+	if snapshotIDs || walIDs {
+		if err := d.writeSnapshot(p); nil != err {
+			wal.Close()
+			return err
+		}
+	}
+	d.persist = p
+	if d.snapshotInterval > 0 {
+		go d.snapshotLoop(p, d.snapshotInterval)
+	}
+	return nil
+}
+
+//log appends the operation to the write-ahead log, it must be called under the lock before the change is applied.
+//Writes log the _id of the documents they changed as query, see idQuery.
+//A record that cannot be written completely is cut off again so the records logged after it can be replayed
+func (d *mapDriver) log(op string, query, doc Document) error {
+	p := d.persist
+	if nil == p {
+		return nil
+	}
+	if nil != p.failed {
+		return p.failed
+	}
+	if p.closed {
+		return ErrClosed
+	}
+	data, err := bson.Marshal(walRecord{Seq: p.seq + 1, Op: op, DB: d.database, Table: d.collection, Query: query, Doc: doc})
+	if nil != err {
+		return err
+	}
+	if len(data) > mapWALMaxRecord {
+		return fmt.Errorf("%s of %d bytes is too large for the write-ahead log", op, len(data))
+	}
+	n, err := p.wal.Write(data)
+	if nil == err && p.sync {
+		err = p.wal.Sync()
+	}
+	if nil != err {
+		if terr := p.wal.Truncate(p.offset); nil != terr {
+			p.failed = fmt.Errorf("write-ahead log %s is damaged: %v", p.wal.Name(), terr)
+		}
+		return err
+	}
+	p.offset += int64(n)
+	p.seq++
+	return nil
+}
+
+func (d *mapDriver) snapshotLoop(p *mapPersistence, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.snapshot(); nil != err {
+				d.mu.Lock()
+				p.err = err
+				d.mu.Unlock()
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+//Close stops the scheduled snapshots, writes a last one and closes the log.
+//Clones share the persistence and are closed as well, the in memory driver has nothing to release
+func (d *mapDriver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := d.persist
+	if nil == p || p.closed {
+		return nil
+	}
+	close(p.stop)
+	err := d.writeSnapshot(p)
+	p.closed = true
+	if cerr := p.wal.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}
+
+//Ping reports the error a persistent driver could not be opened with, ErrClosed after Close
+//and the error of the last scheduled snapshot if it failed
+func (d *mapDriver) Ping(ctx context.Context) error {
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if nil == d.persist {
+		return nil
+	}
+	if nil != d.persist.failed {
+		return d.persist.failed
+	}
+	if d.persist.closed {
+		return ErrClosed
+	}
+	return d.persist.err
+}
+
+func (d *mapDriver) Health() HealthReport {
+	var report = HealthReport{Driver: "map", CheckedAt: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), HealthTimeout)
+	defer cancel()
+	report.Err = d.Ping(ctx)
+	report.Latency = time.Since(report.CheckedAt)
+	report.Healthy = nil == report.Err
+	return report
+}
+
+//snapshot writes the whole store next to the log and truncates the log
+func (d *mapDriver) snapshot() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := d.persist
+	if nil == p {
+		return fmt.Errorf("map driver is not persistent")
+	}
+	if p.closed {
+		return ErrClosed
+	}
+	return d.writeSnapshot(p)
+}
+
+//writeSnapshot must be called under the lock. The snapshot is on disk before the log is truncated
+//and keeps the sequence number of the last record it holds, a log left behind by a crash is not applied twice
+func (d *mapDriver) writeSnapshot(p *mapPersistence) error {
+	data, err := bson.Marshal(mapSnapshot{Seq: p.seq, Store: d.store, Indexes: d.indexSpecs()})
+	if nil != err {
+		return err
+	}
+	tmp := filepath.Join(p.dir, mapSnapshotFile+".tmp")
+	if err := writeFileSync(tmp, data); nil != err {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(p.dir, mapSnapshotFile)); nil != err {
+		return err
+	}
+	p.err = nil
+	if err := p.wal.Truncate(0); nil != err {
+		return err
+	}
+	p.offset = 0
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if nil != err {
+		return err
+	}
+	if _, err := f.Write(data); nil != err {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); nil != err {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//loadSnapshot reports whether documents of the snapshot had to be given an _id
+func (d *mapDriver) loadSnapshot(p *mapPersistence, path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if nil != err {
+		return false, err
+	}
+	var snapshot mapSnapshot
+	if err := bson.Unmarshal(data, &snapshot); nil != err {
+		return false, fmt.Errorf("corrupt snapshot %s: %v", path, err)
+	}
+	p.seq = snapshot.Seq
+	if nil != snapshot.Store {
+		d.store = snapshot.Store
+	}
+	for db, cols := range snapshot.Indexes {
+		for col, specs := range cols {
+			d.database, d.collection = db, col
+			for _, spec := range specs {
+				if err := d.ensureIndex(spec.Fields, spec.Unique); nil != err {
+					return false, fmt.Errorf("cannot rebuild index on %s.%s: %v", db, col, err)
+				}
+			}
+		}
+	}
+	var gaveIDs bool
+	for db, cols := range d.store {
+		for col := range cols {
+			d.database, d.collection = db, col
+			if d.ensureIDIndex() {
+				gaveIDs = true
+			}
+		}
+	}
+	return gaveIDs, nil
+}
+
+//replayWAL applies every complete record of the log the snapshot does not hold yet,
+//a partially written last record is cut off. It reports whether inserted documents had to be given an _id
+func (d *mapDriver) replayWAL(p *mapPersistence, path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if nil != err {
+		return false, err
+	}
+	var gaveIDs bool
+	defer f.Close()
+	var offset int64
+	var size [4]byte
+	for i := 0; ; i++ {
+		if _, err := io.ReadFull(f, size[:]); nil != err {
+			break
+		}
+		n := int(binary.LittleEndian.Uint32(size[:]))
+		if n > mapWALMaxRecord {
+			return false, fmt.Errorf("corrupt write-ahead log %s, record %d at offset %d claims %d bytes", path, i, offset, n)
+		}
+		if n < len(size) {
+			break
+		}
+		var data = make([]byte, n)
+		copy(data, size[:])
+		if _, err := io.ReadFull(f, data[len(size):]); nil != err {
+			break
+		}
+		var record walRecord
+		if err := bson.Unmarshal(data, &record); nil != err {
+			break
+		}
+		offset += int64(n)
+		//records written before they were numbered have no Seq and are always applied
+		if 0 != record.Seq && record.Seq <= p.seq {
+			continue
+		}
+		if _, ok := record.Doc["_id"]; record.Op == "insert" && !ok {
+			gaveIDs = true
+		}
+		//a write rejected by a unique index was logged before it failed and fails the same way again
+		if err := d.replay(record); nil != err && !isDuplicateKey(err) {
+			return false, fmt.Errorf("cannot replay record %d at offset %d of %s, %s on %s.%s with query %v: %v",
+				i, offset-int64(n), path, record.Op, record.DB, record.Table, record.Query, err)
+		}
+		if record.Seq > p.seq {
+			p.seq = record.Seq
+		}
+	}
+	p.offset = offset
+	return gaveIDs, f.Truncate(offset)
+}
+
+func (d *mapDriver) replay(record walRecord) error {
+	d.database, d.collection = record.DB, record.Table
+	switch record.Op {
+	case "insert":
+		return d.Insert(record.Doc)
+	case "update":
+		return d.Update(record.Query, record.Doc)
+	case "updateMulti":
+		_, err := d.UpdateMulti(record.Query, record.Doc)
+		return err
+	case "updateWith", "updateMultiWith":
+		_, _, _, err := d.updateWith(context.Background(), record.Op, record.Query, record.Doc, record.Op == "updateMultiWith", false)
+		return err
+	case "remove":
+		return d.Remove(record.Query)
+	case "removeMulti":
+		_, err := d.RemoveMulti(record.Query)
+		return err
+	case "ensureIndex":
+		var fields []string
+		for _, field := range toSlice(record.Doc["fields"]) {
+			name, _ := field.(string)
+			fields = append(fields, name)
+		}
+		unique, _ := record.Doc["unique"].(bool)
+		return d.ensureIndex(fields, unique)
+	}
+	return fmt.Errorf("unknown operation")
+}
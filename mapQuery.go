@@ -0,0 +1,603 @@
+package storageDriver
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+//operatorDocument wraps every value of Doc into {op: value} the way mongo expects comparison operators
+func operatorDocument(op string, Doc Document) Document {
+	var newDoc = make(Document)
+	for k, v := range Doc {
+		newDoc[k] = Document{op: v}
+	}
+	return newDoc
+}
+
+//compileFilter turns a Filter into the map driver's native form, a predicate run against the stored documents
+func compileFilter(f Filter) (func(Document) bool, error) {
+	switch f := f.(type) {
+	case nil:
+		return func(Document) bool { return true }, nil
+	case DocumentFilter:
+		return compileQuery(f.Query)
+	case Comparison:
+		switch f.Op {
+		case OpEq, OpNe, OpGt, OpGte, OpLt, OpLte, OpIn, OpNin, OpRegex:
+		default:
+			return nil, fmt.Errorf("unsupported comparison operator %q", f.Op)
+		}
+		cond, err := compileCondition(Document{string(f.Op): f.Value})
+		if nil != err {
+			return nil, err
+		}
+		return func(doc Document) bool {
+			val, ok := lookupPath(doc, f.Field)
+			return matchValue(val, ok, cond)
+		}, nil
+	case Existence:
+		return func(doc Document) bool {
+			_, ok := lookupPath(doc, f.Field)
+			return ok == f.Exists
+		}, nil
+	case ArrayPredicate:
+		switch f.Op {
+		case OpAll, OpSize:
+			return func(doc Document) bool {
+				val, ok := lookupPath(doc, f.Field)
+				return matchOperator(val, ok, string(f.Op), f.Value, Document{})
+			}, nil
+		case OpElemMatch:
+			sub, ok := f.Value.(Filter)
+			if !ok {
+				return nil, fmt.Errorf("%s expects a Filter", f.Op)
+			}
+			//the filters mongodb cannot take on the element itself are refused here as well
+			if _, err := FilterToDocument(f); nil != err {
+				return nil, err
+			}
+			pred, err := compileFilter(sub)
+			if nil != err {
+				return nil, err
+			}
+			return func(doc Document) bool {
+				val, _ := lookupPath(doc, f.Field)
+				return anyPathValue(val, func(val interface{}) bool {
+					for _, elem := range toSlice(val) {
+						elemDoc, ok := toDocument(elem)
+						if !ok {
+							elemDoc = Document{"": elem}
+						}
+						if pred(elemDoc) {
+							return true
+						}
+					}
+					return false
+				})
+			}, nil
+		}
+		return nil, fmt.Errorf("unsupported array operator %q", f.Op)
+	case Logical:
+		var preds = make([]func(Document) bool, len(f.Filters))
+		for i, sub := range f.Filters {
+			pred, err := compileFilter(sub)
+			if nil != err {
+				return nil, err
+			}
+			preds[i] = pred
+		}
+		switch f.Op {
+		case OpAnd:
+			return func(doc Document) bool {
+				for _, pred := range preds {
+					if !pred(doc) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		case OpOr, OpNor:
+			want := f.Op == OpOr
+			return func(doc Document) bool {
+				for _, pred := range preds {
+					if pred(doc) {
+						return want
+					}
+				}
+				return !want
+			}, nil
+		}
+		return nil, fmt.Errorf("unsupported logical operator %q", f.Op)
+	case Negation:
+		pred, err := compileFilter(f.Filter)
+		if nil != err {
+			return nil, err
+		}
+		return func(doc Document) bool { return !pred(doc) }, nil
+	}
+	return nil, fmt.Errorf("unsupported filter %T", f)
+}
+
+//compileQuery checks the operators of the mongo shaped query and compiles its regular expressions once,
+//the predicate it returns matches documents with matchDocument. An unknown operator is an error like mongodb gives
+func compileQuery(query Document) (func(Document) bool, error) {
+	compiled, err := compileQueryDocument(query)
+	if nil != err {
+		return nil, err
+	}
+	return func(doc Document) bool { return matchDocument(doc, compiled) }, nil
+}
+
+//compileQueryDocument returns a copy of query whose $regex values are *regexp.Regexp
+func compileQueryDocument(query Document) (Document, error) {
+	var compiled = make(Document, len(query))
+	for k, v := range query {
+		switch k {
+		case "$or", "$and", "$nor":
+			clauses := toSlice(v)
+			if nil == clauses {
+				return nil, fmt.Errorf("%s expects an array", k)
+			}
+			var out = make([]interface{}, len(clauses))
+			for i, clause := range clauses {
+				q, ok := toDocument(clause)
+				if !ok {
+					return nil, fmt.Errorf("%s expects an array of documents", k)
+				}
+				c, err := compileQueryDocument(q)
+				if nil != err {
+					return nil, err
+				}
+				out[i] = c
+			}
+			compiled[k] = out
+			continue
+		}
+		if strings.HasPrefix(k, "$") {
+			return nil, fmt.Errorf("unsupported query operator %s", k)
+		}
+		cond, err := compileCondition(v)
+		if nil != err {
+			return nil, err
+		}
+		compiled[k] = cond
+	}
+	return compiled, nil
+}
+
+//compileCondition checks the operators of a field condition, plain values are returned as they are
+func compileCondition(cond interface{}) (interface{}, error) {
+	ops, ok := toDocument(cond)
+	if !ok || !isOperatorDocument(ops) {
+		return cond, nil
+	}
+	var compiled = make(Document, len(ops))
+	for op, arg := range ops {
+		switch op {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$in", "$nin", "$exists", "$options", "$all", "$size":
+			compiled[op] = arg
+		case "$regex":
+			re, err := compileRegex(arg, ops["$options"])
+			if nil != err {
+				return nil, err
+			}
+			compiled[op] = re
+		case "$elemMatch":
+			sub, ok := toDocument(arg)
+			if !ok {
+				return nil, fmt.Errorf("$elemMatch expects a document")
+			}
+			var err error
+			if isOperatorDocument(sub) {
+				compiled[op], err = compileCondition(sub)
+			} else {
+				compiled[op], err = compileQueryDocument(sub)
+			}
+			if nil != err {
+				return nil, err
+			}
+		case "$not":
+			var err error
+			if _, ok := toDocument(arg); ok {
+				compiled[op], err = compileCondition(arg)
+			} else {
+				compiled[op], err = compileRegex(arg, nil)
+			}
+			if nil != err {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported query operator %s", op)
+		}
+	}
+	return compiled, nil
+}
+
+//matchDocument reports whether doc satisfies the mongo shaped query, keys may be dotted paths.
+//The query is supposed to be compiled with compileQueryDocument, operators it does not know match nothing
+func matchDocument(doc Document, query Document) bool {
+	for k, v := range query {
+		switch k {
+		case "$or":
+			if !matchAny(doc, v) {
+				return false
+			}
+			continue
+		case "$and":
+			if !matchAll(doc, v) {
+				return false
+			}
+			continue
+		case "$nor":
+			if matchAny(doc, v) {
+				return false
+			}
+			continue
+		}
+		val, ok := lookupPath(doc, k)
+		if !matchValue(val, ok, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(doc Document, clauses interface{}) bool {
+	for _, clause := range toSlice(clauses) {
+		if q, ok := toDocument(clause); ok && matchDocument(doc, q) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAll(doc Document, clauses interface{}) bool {
+	for _, clause := range toSlice(clauses) {
+		if q, ok := toDocument(clause); !ok || !matchDocument(doc, q) {
+			return false
+		}
+	}
+	return true
+}
+
+//matchValue checks a single field value against either a plain value or an operator document
+func matchValue(val interface{}, exists bool, cond interface{}) bool {
+	ops, ok := toDocument(cond)
+	if !ok || !isOperatorDocument(ops) {
+		return matchEqual(val, exists, cond)
+	}
+	for op, arg := range ops {
+		if !matchOperator(val, exists, op, arg, ops) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchOperator(val interface{}, exists bool, op string, arg interface{}, ops Document) bool {
+	switch op {
+	case "$eq":
+		return matchEqual(val, exists, arg)
+	case "$ne":
+		return !matchEqual(val, exists, arg)
+	case "$gt", "$gte", "$lt", "$lte":
+		return exists && anyValue(val, func(v interface{}) bool {
+			c, ok := compareValues(v, arg)
+			if !ok {
+				return false
+			}
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			}
+			return c <= 0
+		})
+	case "$in":
+		for _, candidate := range toSlice(arg) {
+			if matchEqual(val, exists, candidate) {
+				return true
+			}
+		}
+		return false
+	case "$nin":
+		return !matchOperator(val, exists, "$in", arg, ops)
+	case "$exists":
+		want, _ := arg.(bool)
+		return exists == want
+	case "$regex":
+		re, _ := compileRegex(arg, ops["$options"])
+		return exists && re != nil && anyValue(val, func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		})
+	case "$options":
+		return true
+	case "$all":
+		wants := toSlice(arg)
+		for _, want := range wants {
+			if !exists || !anyValue(val, func(v interface{}) bool { return equalValues(v, want) }) {
+				return false
+			}
+		}
+		return len(wants) > 0
+	case "$size":
+		size, ok := toFloat(arg)
+		return exists && ok && anyPathValue(val, func(val interface{}) bool {
+			elems := toSlice(val)
+			return nil != elems && float64(len(elems)) == size
+		})
+	case "$elemMatch":
+		cond, ok := toDocument(arg)
+		if !ok || !exists {
+			return false
+		}
+		return anyPathValue(val, func(val interface{}) bool {
+			for _, elem := range toSlice(val) {
+				if elemDoc, isDoc := toDocument(elem); isDoc && !isOperatorDocument(cond) {
+					if matchDocument(elemDoc, cond) {
+						return true
+					}
+				} else if matchValue(elem, true, cond) {
+					return true
+				}
+			}
+			return false
+		})
+	case "$not":
+		if _, ok := toDocument(arg); !ok {
+			return !matchOperator(val, exists, "$regex", arg, Document{})
+		}
+		return !matchValue(val, exists, arg)
+	}
+	return false
+}
+
+//matchEqual is an equality condition, like mongo a nil value also matches a missing field
+func matchEqual(val interface{}, exists bool, want interface{}) bool {
+	if !exists {
+		return nil == want
+	}
+	return anyValue(val, func(v interface{}) bool { return equalValues(v, want) })
+}
+
+//compileRegex accepts a pattern string, a bson.RegEx or an already compiled *regexp.Regexp
+func compileRegex(pattern interface{}, options interface{}) (*regexp.Regexp, error) {
+	var expr, flags string
+	switch p := pattern.(type) {
+	case string:
+		expr = p
+	case bson.RegEx:
+		expr, flags = p.Pattern, p.Options
+	case *regexp.Regexp:
+		return p, nil
+	default:
+		return nil, fmt.Errorf("$regex expects a string, got %T", pattern)
+	}
+	if o, ok := options.(string); ok {
+		flags += o
+	}
+	var goFlags string
+	for _, f := range flags {
+		if strings.ContainsRune("ims", f) && !strings.ContainsRune(goFlags, f) {
+			goFlags += string(f)
+		}
+	}
+	if goFlags != "" {
+		expr = "(?" + goFlags + ")" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+//anyValue applies fn to the value itself and, like mongo does, to every element when the value is an array
+func anyValue(val interface{}, fn func(interface{}) bool) bool {
+	if values, ok := val.(pathValues); ok {
+		for _, v := range values {
+			if anyValue(v, fn) {
+				return true
+			}
+		}
+		return false
+	}
+	if fn(val) {
+		return true
+	}
+	if _, isBytes := val.([]byte); isBytes {
+		return false
+	}
+	for _, v := range toSlice(val) {
+		if fn(v) {
+			return true
+		}
+	}
+	return false
+}
+
+//anyPathValue applies fn to each value a path fanned out to, or to val when it did not fan out
+func anyPathValue(val interface{}, fn func(interface{}) bool) bool {
+	values, ok := val.(pathValues)
+	if !ok {
+		return fn(val)
+	}
+	for _, v := range values {
+		if fn(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOperatorDocument(doc Document) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	for k := range doc {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func toDocument(v interface{}) (Document, bool) {
+	switch d := v.(type) {
+	case Document:
+		return d, true
+	case bson.M:
+		return Document(d), true
+	case bson.D:
+		return Document(d.Map()), true
+	}
+	return nil, false
+}
+
+func toSlice(v interface{}) []interface{} {
+	switch s := v.(type) {
+	case []interface{}:
+		return s
+	case nil, string, []byte:
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil
+	}
+	var out = make([]interface{}, rv.Len())
+	for i := range out {
+		out[i] = rv.Index(i).Interface()
+	}
+	return out
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+//toBigFloat holds any number exactly, integers beyond 2^53 lose precision in a float64
+func toBigFloat(v interface{}) (*big.Float, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return new(big.Float).SetInt64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return new(big.Float).SetUint64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		if f := rv.Float(); !math.IsNaN(f) {
+			return new(big.Float).SetFloat64(f), true
+		}
+	}
+	return nil, false
+}
+
+//compareValues returns -1, 0 or 1 and false when the two values are not comparable
+func compareValues(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		//rounding to float64 keeps the order, only numbers rounded to the same float need the exact comparison
+		if fa == fb {
+			if ba, ok := toBigFloat(a); ok {
+				if bb, ok := toBigFloat(b); ok {
+					return ba.Cmp(bb), true
+				}
+			}
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	case time.Time:
+		bv, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av.Before(bv):
+			return -1, true
+		case av.After(bv):
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		bv, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av == bv:
+			return 0, true
+		case bv:
+			return -1, true
+		}
+		return 1, true
+	case bson.ObjectId:
+		bv, ok := b.(bson.ObjectId)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(string(av), string(bv)), true
+	}
+	return 0, false
+}
+
+func equalValues(a, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	if da, ok := toDocument(a); ok {
+		db, ok := toDocument(b)
+		if !ok || len(da) != len(db) {
+			return false
+		}
+		for k, v := range da {
+			if w, ok := db[k]; !ok || !equalValues(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	if sa, sb := toSlice(a), toSlice(b); sa != nil && sb != nil {
+		if len(sa) != len(sb) {
+			return false
+		}
+		for i := range sa {
+			if !equalValues(sa[i], sb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
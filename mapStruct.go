@@ -0,0 +1,60 @@
+package storageDriver
+
+import "context"
+
+func (d *mapDriver) InsertStruct(Doc interface{}) error {
+	return d.InsertStructCtx(context.Background(), Doc)
+}
+func (d *mapDriver) InsertStructCtx(ctx context.Context, Doc interface{}) error {
+	doc, err := ToDocument(Doc)
+	if nil != err {
+		return err
+	}
+	return d.InsertCtx(ctx, doc)
+}
+func (d *mapDriver) SaveStruct(Query Document, Doc interface{}) error {
+	return d.SaveStructCtx(context.Background(), Query, Doc)
+}
+func (d *mapDriver) SaveStructCtx(ctx context.Context, Query Document, Doc interface{}) error {
+	doc, err := ToDocument(Doc)
+	if nil != err {
+		return err
+	}
+	return d.SaveCtx(ctx, Query, doc)
+}
+func (d *mapDriver) UpdateStruct(Query Document, Doc interface{}) error {
+	return d.UpdateStructCtx(context.Background(), Query, Doc)
+}
+func (d *mapDriver) UpdateStructCtx(ctx context.Context, Query Document, Doc interface{}) error {
+	doc, err := ToDocument(Doc)
+	if nil != err {
+		return err
+	}
+	return d.UpdateCtx(ctx, Query, doc)
+}
+func (d *mapDriver) GetInto(Query Document, Out interface{}) error {
+	return d.GetIntoCtx(context.Background(), Query, Out)
+}
+func (d *mapDriver) GetIntoCtx(ctx context.Context, Query Document, Out interface{}) error {
+	if err := checkSliceOut(Out); nil != err {
+		return err
+	}
+	docs, err := d.GetCtx(ctx, Query)
+	if nil != err {
+		return err
+	}
+	return DecodeDocuments(docs, Out)
+}
+func (d *mapDriver) GetOneInto(Query Document, Out interface{}) error {
+	return d.GetOneIntoCtx(context.Background(), Query, Out)
+}
+func (d *mapDriver) GetOneIntoCtx(ctx context.Context, Query Document, Out interface{}) error {
+	if err := checkOut(Out); nil != err {
+		return err
+	}
+	doc, err := d.GetOneCtx(ctx, Query)
+	if nil != err {
+		return err
+	}
+	return FromDocument(doc, Out)
+}
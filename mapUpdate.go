@@ -0,0 +1,420 @@
+package storageDriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+//mapUpdateOrder is the order update operators are applied in, claim keeps them from touching the same field
+var mapUpdateOrder = []string{"$set", "$unset", "$inc", "$mul", "$min", "$max", "$push", "$addToSet", "$pull", "$rename", "$currentDate"}
+
+func (d *mapDriver) UpdateWith(Query Document, Change *Update) error {
+	return d.UpdateWithCtx(context.Background(), Query, Change)
+}
+func (d *mapDriver) UpdateWithCtx(ctx context.Context, Query Document, Change *Update) error {
+	ops, err := Change.Document()
+	if nil != err {
+		return err
+	}
+	_, _, _, err = d.updateWith(ctx, "updateWith", Query, ops, false, false)
+	return err
+}
+func (d *mapDriver) UpdateMultiWith(Query Document, Change *Update) (int, error) {
+	return d.UpdateMultiWithCtx(context.Background(), Query, Change)
+}
+func (d *mapDriver) UpdateMultiWithCtx(ctx context.Context, Query Document, Change *Update) (int, error) {
+	ops, err := Change.Document()
+	if nil != err {
+		return 0, err
+	}
+	matched, _, _, err := d.updateWith(ctx, "updateMultiWith", Query, ops, true, false)
+	return matched, err
+}
+func (d *mapDriver) SaveWith(Query Document, Change *Update) error {
+	return d.SaveWithCtx(context.Background(), Query, Change)
+}
+func (d *mapDriver) SaveWithCtx(ctx context.Context, Query Document, Change *Update) error {
+	ops, err := Change.Document()
+	if nil != err {
+		return err
+	}
+	_, _, _, err = d.updateWith(ctx, "updateWith", Query, ops, false, true)
+	return err
+}
+
+func (d *mapDriver) FindAndUpdate(Query Document, Change *Update, Options FindAndUpdateOptions) (Document, error) {
+	return d.FindAndUpdateCtx(context.Background(), Query, Change, Options)
+}
+func (d *mapDriver) FindAndUpdateCtx(ctx context.Context, Query Document, Change *Update, Options FindAndUpdateOptions) (Document, error) {
+	ops, err := Change.Document()
+	if nil != err {
+		return nil, err
+	}
+	return d.findAndModify(ctx, Query, ops, Options, false)
+}
+func (d *mapDriver) FindAndRemove(Query Document) (Document, error) {
+	return d.FindAndRemoveCtx(context.Background(), Query)
+}
+func (d *mapDriver) FindAndRemoveCtx(ctx context.Context, Query Document) (Document, error) {
+	return d.findAndModify(ctx, Query, nil, FindAndUpdateOptions{}, true)
+}
+
+//findAndModify picks, changes or removes and returns a document under a single lock.
+//The log keeps the _id of the picked document, a replay changes the same one whatever order the matches come in
+func (d *mapDriver) findAndModify(ctx context.Context, query, ops Document, opts FindAndUpdateOptions, remove bool) (Document, error) {
+	match, err := compileQuery(query)
+	if nil != err {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var matched []Document
+	for _, doc := range d.plan(query) {
+		if err := ctx.Err(); nil != err {
+			return nil, err
+		}
+		if match(doc) {
+			matched = append(matched, doc)
+			if len(opts.Sort) == 0 {
+				break
+			}
+		}
+	}
+	sortDocuments(matched, opts.Sort)
+	var project = func(doc Document) Document {
+		if len(opts.Fields) > 0 {
+			return d.copyDocument(projectDocument(doc, opts.Fields))
+		}
+		return d.copyDocument(doc)
+	}
+	if remove {
+		if len(matched) == 0 {
+			return nil, ErrNotFound
+		}
+		if err := d.log("remove", idQuery(matched[0]), nil); nil != err {
+			return nil, err
+		}
+		d.store[d.database][d.collection] = removeDocument(d.store[d.database][d.collection], matched[0])
+		d.indexRemove(matched[0])
+		return project(matched[0]), nil
+	}
+	ops = resolveCurrentDate(ops, time.Now().Truncate(time.Millisecond))
+	if len(matched) == 0 {
+		if !opts.Upsert {
+			return nil, ErrNotFound
+		}
+		doc, err := applyUpdate(upsertDocument(query), ops)
+		if nil != err {
+			return nil, err
+		}
+		doc = d.copyDocument(doc)
+		if err := d.insert(doc); nil != err {
+			return nil, err
+		}
+		if !opts.ReturnNew {
+			return nil, nil
+		}
+		return project(doc), nil
+	}
+	doc := matched[0]
+	updated, err := applyUpdate(doc, ops)
+	if nil != err {
+		return nil, err
+	}
+	updated = d.copyDocument(updated)
+	if err := idCheck(doc, updated); nil != err {
+		return nil, err
+	}
+	if err := d.indexCheck(updated, doc); nil != err {
+		return nil, err
+	}
+	if err := d.log("updateWith", idQuery(doc), ops); nil != err {
+		return nil, err
+	}
+	var result = project(doc)
+	d.replaceDocument(doc, updated)
+	if opts.ReturnNew {
+		result = project(doc)
+	}
+	return result, nil
+}
+
+//updateWith finds and changes the documents under a single lock so no other write can come in between.
+//The change is checked against every document and the unique indexes before anything is logged or applied.
+//It returns how many documents matched and changed, and the inserted document of an upsert
+func (d *mapDriver) updateWith(ctx context.Context, op string, query, ops Document, multi, upsert bool) (int, int, Document, error) {
+	match, err := compileQuery(query)
+	if nil != err {
+		return 0, 0, nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	//the time is fixed before logging so a replay sets the same dates, bson keeps milliseconds only
+	ops = resolveCurrentDate(ops, time.Now().Truncate(time.Millisecond))
+	docs, err := d.matching(ctx, query, match, !multi)
+	if errors.Is(err, ErrNotFound) && upsert {
+		doc, err := applyUpdate(upsertDocument(query), ops)
+		if nil != err {
+			return 0, 0, nil, err
+		}
+		doc = d.copyDocument(doc)
+		if err := d.insert(doc); nil != err {
+			return 0, 0, nil, err
+		}
+		return 0, 0, doc, nil
+	}
+	if nil != err {
+		return 0, 0, nil, err
+	}
+	var updated = make([]Document, len(docs))
+	var modified int
+	for i, doc := range docs {
+		if updated[i], err = applyUpdate(doc, ops); nil != err {
+			return 0, 0, nil, err
+		}
+		updated[i] = d.copyDocument(updated[i])
+		if err := idCheck(doc, updated[i]); nil != err {
+			return 0, 0, nil, err
+		}
+		if err := d.indexCheck(updated[i], doc); nil != err {
+			return 0, 0, nil, err
+		}
+		if !reflect.DeepEqual(doc, updated[i]) {
+			modified++
+		}
+	}
+	if err := d.indexCheckBatch(updated); nil != err {
+		return 0, 0, nil, err
+	}
+	if err := d.log(op, idQuery(docs...), ops); nil != err {
+		return 0, 0, nil, err
+	}
+	for i, doc := range docs {
+		d.replaceDocument(doc, updated[i])
+	}
+	return len(docs), modified, nil, nil
+}
+
+//replaceDocument swaps the contents of the stored doc keeping its identity, which the indexes rely on
+func (d *mapDriver) replaceDocument(doc, updated Document) {
+	d.indexRemove(doc)
+	for k := range doc {
+		delete(doc, k)
+	}
+	for k, v := range updated {
+		doc[k] = v
+	}
+	d.indexAdd(doc)
+}
+
+//upsertDocument starts an upserted document with the equality conditions of the query, dotted keys become nested documents
+func upsertDocument(query Document) Document {
+	var doc = make(Document)
+	for k, v := range query {
+		if len(k) > 0 && k[0] == '$' {
+			continue
+		}
+		if cond, ok := toDocument(v); ok && isOperatorDocument(cond) {
+			if eq, ok := cond["$eq"]; ok {
+				setPath(doc, k, eq)
+			}
+			continue
+		}
+		setPath(doc, k, v)
+	}
+	return doc
+}
+
+//resolveCurrentDate turns $currentDate into a $set of now
+func resolveCurrentDate(ops Document, now time.Time) Document {
+	dates, ok := toDocument(ops["$currentDate"])
+	if !ok {
+		return ops
+	}
+	var resolved = make(Document, len(ops))
+	for op, fields := range ops {
+		resolved[op] = fields
+	}
+	set, _ := toDocument(resolved["$set"])
+	var merged = make(Document, len(set)+len(dates))
+	for k, v := range set {
+		merged[k] = v
+	}
+	for field := range dates {
+		merged[field] = now
+	}
+	resolved["$set"] = merged
+	delete(resolved, "$currentDate")
+	return resolved
+}
+
+//applyUpdate returns a copy of doc changed by the update operators, doc and its arrays are left untouched
+func applyUpdate(doc Document, ops Document) (Document, error) {
+	for op := range ops {
+		if !containsString(mapUpdateOrder, op) {
+			return nil, fmt.Errorf("unsupported update operator %s", op)
+		}
+	}
+	var updated = shallowCopy(doc)
+	for _, op := range mapUpdateOrder {
+		raw, ok := ops[op]
+		if !ok {
+			continue
+		}
+		fields, ok := toDocument(raw)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a document", op)
+		}
+		var names = make([]string, 0, len(fields))
+		for field := range fields {
+			names = append(names, field)
+		}
+		sort.Strings(names)
+		for _, field := range names {
+			if err := applyOperator(updated, op, field, fields[field]); nil != err {
+				return nil, err
+			}
+		}
+	}
+	return updated, nil
+}
+
+//applyOperator applies op on the dotted path field of doc, see setPath
+func applyOperator(doc Document, op, field string, arg interface{}) error {
+	current, exists := getPath(doc, field)
+	switch op {
+	case "$set":
+		return setPath(doc, field, arg)
+	case "$unset":
+		return unsetPath(doc, field)
+	case "$inc", "$mul":
+		if _, ok := toFloat(arg); !ok {
+			return fmt.Errorf("%s on %s expects a number, got %v", op, field, arg)
+		}
+		//a missing field counts as a zero of the type of arg so $inc sets arg and $mul a zero of its type
+		if !exists {
+			current = reflect.Zero(reflect.TypeOf(arg)).Interface()
+		}
+		if _, ok := toFloat(current); !ok {
+			return fmt.Errorf("cannot apply %s to the non numeric field %s", op, field)
+		}
+		var sign byte = '+'
+		if op == "$mul" {
+			sign = '*'
+		}
+		n, exact := arithmetic(sign, current, arg)
+		if !exact {
+			return fmt.Errorf("%s on %s overflows an int64", op, field)
+		}
+		return setPath(doc, field, n)
+	case "$min", "$max":
+		c := sortCompare(arg, current)
+		if !exists || (op == "$min" && c < 0) || (op == "$max" && c > 0) {
+			return setPath(doc, field, arg)
+		}
+	case "$push", "$addToSet":
+		values := []interface{}{arg}
+		if each, ok := toDocument(arg); ok {
+			if _, ok := each["$each"]; ok {
+				values = toSlice(each["$each"])
+			}
+		}
+		array, err := arrayField(current, exists, op, field)
+		if nil != err {
+			return err
+		}
+	next:
+		for _, v := range values {
+			if op == "$addToSet" {
+				for _, have := range array {
+					if equalValues(have, v) {
+						continue next
+					}
+				}
+			}
+			array = append(array, v)
+		}
+		return setPath(doc, field, array)
+	case "$pull":
+		if !exists {
+			return nil
+		}
+		array, err := arrayField(current, exists, op, field)
+		if nil != err {
+			return err
+		}
+		pull, err := pullMatcher(arg)
+		if nil != err {
+			return err
+		}
+		var kept = make([]interface{}, 0, len(array))
+		for _, v := range array {
+			if !pull(v) {
+				kept = append(kept, v)
+			}
+		}
+		return setPath(doc, field, kept)
+	case "$rename":
+		to, ok := arg.(string)
+		if !ok || to == "" {
+			return fmt.Errorf("$rename of %s expects a field name", field)
+		}
+		if exists {
+			if err := unsetPath(doc, field); nil != err {
+				return err
+			}
+			return setPath(doc, to, current)
+		}
+	}
+	return nil
+}
+
+//arrayField returns a copy of the array in the field, a missing field is an empty array
+func arrayField(current interface{}, exists bool, op, field string) ([]interface{}, error) {
+	if !exists || nil == current {
+		return make([]interface{}, 0), nil
+	}
+	array := toSlice(current)
+	if nil == array {
+		return nil, fmt.Errorf("cannot apply %s to the non array field %s", op, field)
+	}
+	return append(make([]interface{}, 0, len(array)+1), array...), nil
+}
+
+//pullMatcher tells whether $pull removes an element, cond is a value, a condition like {"$gt": 1} or a query on sub documents
+func pullMatcher(cond interface{}) (func(v interface{}) bool, error) {
+	query, ok := toDocument(cond)
+	if !ok {
+		return func(v interface{}) bool { return equalValues(v, cond) }, nil
+	}
+	if isOperatorDocument(query) {
+		compiled, err := compileCondition(query)
+		if nil != err {
+			return nil, err
+		}
+		return func(v interface{}) bool { return matchValue(v, true, compiled) }, nil
+	}
+	compiled, err := compileQueryDocument(query)
+	if nil != err {
+		return nil, err
+	}
+	return func(v interface{}) bool {
+		if doc, ok := toDocument(v); ok {
+			return matchDocument(doc, compiled)
+		}
+		return equalValues(v, cond)
+	}, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package storageDriver
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//Bulk returns a BulkWriter sending the writes with mgo bulks, consecutive writes of the same kind go in a single round trip.
+//mongodb does not tell how many documents the updates or removes of a failed round trip changed, they are not counted
+func (d *mongoDriver) Bulk() BulkWriter {
+	return &bulk{ordered: true, run: d.runBulk}
+}
+
+//bulkGroup tells which writes mgo can send together
+func bulkGroup(kind bulkKind) int {
+	switch kind {
+	case bulkInsert:
+		return 0
+	case bulkRemove, bulkRemoveAll:
+		return 2
+	}
+	return 1
+}
+
+func (d *mongoDriver) runBulk(ctx context.Context, ordered bool, ops []bulkOp, result *BulkResult) error {
+	var groups [][]bulkOp
+	if ordered {
+		for i, op := range ops {
+			if i == 0 || bulkGroup(op.kind) != bulkGroup(ops[i-1].kind) {
+				groups = append(groups, nil)
+			}
+			groups[len(groups)-1] = append(groups[len(groups)-1], op)
+		}
+	} else {
+		var byGroup = make(map[int]int)
+		for _, op := range ops {
+			i, ok := byGroup[bulkGroup(op.kind)]
+			if !ok {
+				i = len(groups)
+				byGroup[bulkGroup(op.kind)] = i
+				groups = append(groups, nil)
+			}
+			groups[i] = append(groups[i], op)
+		}
+	}
+	//the groups fill a result of their own, it is merged once they are done so a done ctx never races them
+	sent, err := withResult(ctx, d, func(col *mgo.Collection) (*BulkResult, error) {
+		var sent = &BulkResult{UpsertedIDs: make(map[int]interface{})}
+		for _, group := range groups {
+			if err := ctx.Err(); nil != err {
+				return sent, err
+			}
+			if !runBulkGroup(col, ordered, group, sent) && ordered {
+				return sent, nil
+			}
+		}
+		return sent, nil
+	})
+	if nil != sent {
+		result.Inserted += sent.Inserted
+		result.Matched += sent.Matched
+		result.Modified += sent.Modified
+		result.Upserted += sent.Upserted
+		result.Removed += sent.Removed
+		for index, id := range sent.UpsertedIDs {
+			result.UpsertedIDs[index] = id
+		}
+		result.Errors = append(result.Errors, sent.Errors...)
+	}
+	return err
+}
+
+//runBulkGroup sends writes of the same group and reports whether all of them succeeded
+func runBulkGroup(col *mgo.Collection, ordered bool, ops []bulkOp, result *BulkResult) bool {
+	var b = col.Bulk()
+	if !ordered {
+		b.Unordered()
+	}
+	//the _id given to each upsert, to find out afterwards which ones inserted a document
+	var upsertIDs = make(map[int]bson.ObjectId)
+	for _, op := range ops {
+		switch op.kind {
+		case bulkInsert:
+			b.Insert(op.doc)
+		case bulkUpdate:
+			b.Update(op.query, op.update)
+		case bulkUpdateAll:
+			b.UpdateAll(op.query, op.update)
+		case bulkUpsert:
+			if _, ok := op.query["_id"]; !ok && !updatesID(op.update) {
+				id := bson.NewObjectId()
+				setOnInsert, _ := op.update["$setOnInsert"].(Document)
+				if nil == setOnInsert {
+					setOnInsert = Document{}
+					op.update["$setOnInsert"] = setOnInsert
+				}
+				setOnInsert["_id"] = id
+				upsertIDs[op.index] = id
+			}
+			b.Upsert(op.query, op.update)
+		case bulkRemove:
+			b.Remove(op.query)
+		case bulkRemoveAll:
+			b.RemoveAll(op.query)
+		}
+	}
+	res, err := b.Run()
+	upserted := bulkUpserted(col, upsertIDs, result)
+	if nil == err {
+		switch bulkGroup(ops[0].kind) {
+		case 0:
+			result.Inserted += len(ops)
+		case 1:
+			result.Matched += res.Matched - upserted
+			result.Modified += res.Modified
+		case 2:
+			result.Removed += res.Matched
+		}
+		return true
+	}
+	var cases []mgo.BulkErrorCase
+	if berr, ok := err.(*mgo.BulkError); ok {
+		cases = berr.Cases()
+	} else {
+		cases = []mgo.BulkErrorCase{{Index: -1, Err: err}}
+	}
+	for _, c := range cases {
+		index := -1
+		if c.Index >= 0 && c.Index < len(ops) {
+			index = ops[c.Index].index
+		}
+		result.Errors = append(result.Errors, BulkItemError{Index: index, Err: mongoError("Bulk", c.Err)})
+	}
+	if bulkGroup(ops[0].kind) == 0 {
+		//an ordered insert stops at its first failure, an unordered one only skips the failed documents
+		if ordered && cases[0].Index >= 0 {
+			result.Inserted += cases[0].Index
+		} else if !ordered {
+			result.Inserted += len(ops) - len(cases)
+		}
+	}
+	return false
+}
+
+//updatesID reports whether an update sets the _id itself, mongodb rejects a $setOnInsert of it then
+func updatesID(update Document) bool {
+	for _, fields := range update {
+		if fields, ok := fields.(Document); ok {
+			if _, ok := fields["_id"]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//bulkUpserted looks up the _id given to the upserts and records the ones which inserted a document
+func bulkUpserted(col *mgo.Collection, ids map[int]bson.ObjectId, result *BulkResult) int {
+	if len(ids) == 0 {
+		return 0
+	}
+	var list = make([]bson.ObjectId, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, id)
+	}
+	var found []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	if nil != col.Find(bson.M{"_id": bson.M{"$in": list}}).Select(bson.M{"_id": 1}).All(&found) {
+		return 0
+	}
+	var inserted = make(map[bson.ObjectId]bool, len(found))
+	for _, doc := range found {
+		inserted[doc.ID] = true
+	}
+	for index, id := range ids {
+		if inserted[id] {
+			result.Upserted++
+			result.UpsertedIDs[index] = id
+		}
+	}
+	return len(found)
+}
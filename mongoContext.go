@@ -0,0 +1,316 @@
+package storageDriver
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//withContext runs fn against the current collection bound to a session copy following ctx, see withSession
+func (d *mongoDriver) withContext(ctx context.Context, fn func(col *mgo.Collection) error) error {
+	d.mu.RLock()
+	col, closed := d.col, nil == d.session
+	d.mu.RUnlock()
+	if !closed && nil == col {
+		return ErrNoCollection
+	}
+	//a driver closed meanwhile has no session to copy, withSession gives ErrClosed before fn runs
+	return d.withSession(ctx, func(session *mgo.Session) error {
+		return fn(col.With(session))
+	})
+}
+
+//withSession runs fn against a copy of the session whose socket and sync timeouts follow the deadline of ctx.
+//When ctx is done first, ctx.Err() is returned right away and the copy is closed once fn gives its socket back.
+//A write sent by then is not taken back, it may still be applied after ctx.Err() was returned
+func (d *mongoDriver) withSession(ctx context.Context, fn func(session *mgo.Session) error) error {
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	session, _, err := d.copySession()
+	if nil != err {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			session.Close()
+			return context.DeadlineExceeded
+		}
+		session.SetSocketTimeout(timeout)
+		session.SetSyncTimeout(timeout)
+	}
+	var done = make(chan error, 1)
+	go func() {
+		done <- fn(session)
+	}()
+	select {
+	case err := <-done:
+		session.Close()
+		return err
+	case <-ctx.Done():
+		go func() {
+			<-done
+			session.Close()
+		}()
+		return ctx.Err()
+	}
+}
+
+//withResult is withContext for operations producing a value. fn builds the value on its own and it is only handed
+//back once fn has returned, when ctx is done first the zero value is returned and fn keeps the value to itself
+func withResult[T any](ctx context.Context, d *mongoDriver, fn func(col *mgo.Collection) (T, error)) (T, error) {
+	var results = make(chan T, 1)
+	err := d.withContext(ctx, func(col *mgo.Collection) error {
+		value, err := fn(col)
+		results <- value
+		return err
+	})
+	select {
+	case value := <-results:
+		return value, err
+	default:
+		var zero T
+		return zero, err
+	}
+}
+
+//withMaxTime lets the server abort a query once the deadline of ctx has passed
+func withMaxTime(ctx context.Context, q *mgo.Query) *mgo.Query {
+	if deadline, ok := ctx.Deadline(); ok {
+		q.SetMaxTime(time.Until(deadline))
+	}
+	return q
+}
+
+func (d *mongoDriver) SaveCtx(ctx context.Context, Query, Doc Document) error {
+	return d.withContext(ctx, func(col *mgo.Collection) error {
+		_, err := col.Upsert(Query, Document{"$set": Doc})
+		return mongoError("Save", err)
+	})
+}
+func (d *mongoDriver) GetCtx(ctx context.Context, query Document) ([]Document, error) {
+	return withResult(ctx, d, func(col *mgo.Collection) ([]Document, error) {
+		var docs = make([]Document, 0)
+		return docs, mongoError("Get", withMaxTime(ctx, col.Find(query)).All(&docs))
+	})
+}
+func (d *mongoDriver) GetOneCtx(ctx context.Context, query Document) (Document, error) {
+	return withResult(ctx, d, func(col *mgo.Collection) (Document, error) {
+		var doc = make(Document)
+		return doc, mongoError("GetOne", withMaxTime(ctx, col.Find(query)).One(&doc))
+	})
+}
+func (d *mongoDriver) UpdateCtx(ctx context.Context, query, updateFields Document) error {
+	return d.withContext(ctx, func(col *mgo.Collection) error {
+		return mongoError("Update", col.Update(query, Document{"$set": updateFields}))
+	})
+}
+func (d *mongoDriver) UpdateMultiCtx(ctx context.Context, query, updateFields Document) (int, error) {
+	return withResult(ctx, d, func(col *mgo.Collection) (int, error) {
+		info, err := col.UpdateAll(query, Document{"$set": updateFields})
+		if nil != info {
+			return info.Updated, mongoError("UpdateMulti", err)
+		}
+		return 0, mongoError("UpdateMulti", err)
+	})
+}
+func (d *mongoDriver) InsertCtx(ctx context.Context, Doc Document) error {
+	return d.withContext(ctx, func(col *mgo.Collection) error {
+		return mongoError("Insert", col.Insert(Doc))
+	})
+}
+
+//InsertWithIDCtx generates the _id on the client like the mongodb drivers do, mgo leaves it to the server
+func (d *mongoDriver) InsertWithIDCtx(ctx context.Context, Doc Document) (interface{}, error) {
+	id, ok := Doc["_id"]
+	if !ok {
+		id = bson.NewObjectId()
+		Doc = shallowCopy(Doc)
+		Doc["_id"] = id
+	}
+	err := d.withContext(ctx, func(col *mgo.Collection) error {
+		return mongoError("InsertWithID", col.Insert(Doc))
+	})
+	if nil != err {
+		return nil, err
+	}
+	return id, nil
+}
+func (d *mongoDriver) InsertMultiCtx(ctx context.Context, docs []Document) error {
+	var dcs = make([]interface{}, len(docs))
+	for i := range docs {
+		dcs[i] = docs[i]
+	}
+	return d.withContext(ctx, func(col *mgo.Collection) error {
+		return mongoError("InsertMulti", col.Insert(dcs...))
+	})
+}
+
+//InsertMultiNoFailCtx stops at the first document after ctx is done and reports ctx.Err() as the last error
+func (d *mongoDriver) InsertMultiNoFailCtx(ctx context.Context, docs []Document, ErrorOut ...io.Writer) []error {
+	var errs = make([]error, 0)
+	var lock sync.Mutex
+	var report = func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		errs = append(errs, err)
+		if len(ErrorOut) > 0 {
+			ErrorOut[0].Write([]byte(err.Error()))
+		}
+	}
+	err := d.withContext(ctx, func(col *mgo.Collection) error {
+		for _, doc := range docs {
+			if nil != ctx.Err() {
+				return ctx.Err()
+			}
+			if err := col.Insert(doc); nil != err {
+				report(mongoError("InsertMultiNoFail", err))
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		report(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return append(make([]error, 0, len(errs)), errs...)
+}
+func (d *mongoDriver) RemoveCtx(ctx context.Context, query Document) error {
+	return d.withContext(ctx, func(col *mgo.Collection) error {
+		return mongoError("Remove", col.Remove(query))
+	})
+}
+func (d *mongoDriver) RemoveMultiCtx(ctx context.Context, query Document) (int, error) {
+	return withResult(ctx, d, func(col *mgo.Collection) (int, error) {
+		info, err := col.RemoveAll(query)
+		if nil != info {
+			return info.Removed, mongoError("RemoveMulti", err)
+		}
+		return 0, mongoError("RemoveMulti", err)
+	})
+}
+func (d *mongoDriver) UpdateWithCtx(ctx context.Context, query Document, change *Update) error {
+	ops, err := change.Document()
+	if nil != err {
+		return err
+	}
+	return d.withContext(ctx, func(col *mgo.Collection) error {
+		return mongoError("UpdateWith", col.Update(query, ops))
+	})
+}
+func (d *mongoDriver) UpdateMultiWithCtx(ctx context.Context, query Document, change *Update) (int, error) {
+	ops, err := change.Document()
+	if nil != err {
+		return 0, err
+	}
+	return withResult(ctx, d, func(col *mgo.Collection) (int, error) {
+		info, err := col.UpdateAll(query, ops)
+		if nil != info {
+			return info.Updated, mongoError("UpdateMultiWith", err)
+		}
+		return 0, mongoError("UpdateMultiWith", err)
+	})
+}
+func (d *mongoDriver) SaveWithCtx(ctx context.Context, query Document, change *Update) error {
+	ops, err := change.Document()
+	if nil != err {
+		return err
+	}
+	return d.withContext(ctx, func(col *mgo.Collection) error {
+		_, err := col.Upsert(query, ops)
+		return mongoError("SaveWith", err)
+	})
+}
+func (d *mongoDriver) FindAndUpdateCtx(ctx context.Context, query Document, change *Update, opts FindAndUpdateOptions) (Document, error) {
+	ops, err := change.Document()
+	if nil != err {
+		return nil, err
+	}
+	return d.findAndModify(ctx, "FindAndUpdate", query, mgo.Change{Update: ops, Upsert: opts.Upsert, ReturnNew: opts.ReturnNew}, opts)
+}
+func (d *mongoDriver) FindAndRemoveCtx(ctx context.Context, query Document) (Document, error) {
+	return d.findAndModify(ctx, "FindAndRemove", query, mgo.Change{Remove: true}, FindAndUpdateOptions{})
+}
+
+//findAndModify runs a findAndModify command through Query.Apply, an upsert without ReturnNew gives a nil document
+func (d *mongoDriver) findAndModify(ctx context.Context, op string, query Document, change mgo.Change, opts FindAndUpdateOptions) (Document, error) {
+	return withResult(ctx, d, func(col *mgo.Collection) (Document, error) {
+		var doc Document
+		q := col.Find(query)
+		if len(opts.Sort) > 0 {
+			q.Sort(opts.Sort...)
+		}
+		if len(opts.Fields) > 0 {
+			fieldMap := bson.M{"_id": 0}
+			for _, field := range opts.Fields {
+				fieldMap[field] = 1
+			}
+			q.Select(fieldMap)
+		}
+		_, err := q.Apply(change, &doc)
+		return doc, mongoError(op, err)
+	})
+}
+
+//Close closes the session of the driver, clones have sessions of their own and stay open
+func (d *mongoDriver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if nil == d.session {
+		return nil
+	}
+	d.session.Close()
+	d.session, d.db, d.col = nil, nil, nil
+	return nil
+}
+func (d *mongoDriver) Ping(ctx context.Context) error {
+	return d.withSession(ctx, func(session *mgo.Session) error {
+		return mongoError("Ping", session.Ping())
+	})
+}
+
+//Health reports the pool statistics even when the server is unreachable, once EnableMongoStats has turned them on
+func (d *mongoDriver) Health() HealthReport {
+	var report = HealthReport{Driver: "mongo", CheckedAt: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), HealthTimeout)
+	defer cancel()
+	report.Err = d.Ping(ctx)
+	report.Latency = time.Since(report.CheckedAt)
+	if nil == report.Err {
+		var info mgo.BuildInfo
+		var servers []string
+		//the results are only read when fn has returned, withSession gives ctx.Err() otherwise
+		report.Err = d.withSession(ctx, func(session *mgo.Session) error {
+			var err error
+			info, err = session.BuildInfo()
+			servers = session.LiveServers()
+			return mongoError("BuildInfo", err)
+		})
+		if nil == report.Err {
+			report.ServerVersion, report.Servers = info.Version, servers
+		}
+	}
+	report.Healthy = nil == report.Err
+	if !mongoStats.Load() {
+		return report
+	}
+	stats := mgo.GetStats()
+	report.Pool = PoolStats{
+		Clusters:     stats.Clusters,
+		MasterConns:  stats.MasterConns,
+		SlaveConns:   stats.SlaveConns,
+		SocketsAlive: stats.SocketsAlive,
+		SocketsInUse: stats.SocketsInUse,
+		SocketRefs:   stats.SocketRefs,
+		SentOps:      stats.SentOps,
+		ReceivedOps:  stats.ReceivedOps,
+		ReceivedDocs: stats.ReceivedDocs,
+	}
+	return report
+}
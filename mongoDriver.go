@@ -1,10 +1,11 @@
 package storageDriver
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"net/url"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -12,21 +13,37 @@ import (
 
 var defaultSession *mgo.Session
 
+//crs is an immutable cursor, every chained call returns a copy and the query is built when One, All, Count or Distinct runs it
 type crs struct {
-	or    []interface{}
-	and   bson.M
-	queue []func()
-	q     *mgo.Query
+	driver *mongoDriver
+	or     []interface{}
+	and    bson.M
+	where  []interface{}
+	err    error
+	queue  []func(q *mgo.Query)
 }
 
 type mongoDriver struct {
+	//mu guards the fields against Close, which may run while operations are using the session
+	mu      sync.RWMutex
 	session *mgo.Session
 	db      *mgo.Database
 	col     *mgo.Collection
-	cursor  *crs
+}
+
+//mongoStats tells whether EnableMongoStats has turned on the statistics Health reports
+var mongoStats atomic.Bool
+
+//EnableMongoStats makes mgo collect the pool statistics Health reports. mgo keeps them for the whole process
+//and counting has a cost, so turning them on is left to the program
+func EnableMongoStats() {
+	mgo.SetStats(true)
+	mongoStats.Store(true)
 }
 
 func (d *mongoDriver) DB(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if nil == d.session {
 		return fmt.Errorf("no session was set")
 	}
@@ -35,54 +52,77 @@ func (d *mongoDriver) DB(name string) error {
 	return nil
 }
 func (d *mongoDriver) Table(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if nil == d.db || nil == d.session {
 		return fmt.Errorf("no session or db was set")
 	}
 	d.col = d.db.C(name)
 	return nil
 }
+
+//copySession copies the session under the lock so Close cannot close it midway, col is the current collection or nil
+func (d *mongoDriver) copySession() (*mgo.Session, *mgo.Collection, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if nil == d.session {
+		return nil, nil, ErrClosed
+	}
+	return d.session.Copy(), d.col, nil
+}
+func (d *mongoDriver) EnsureIndex(fields ...string) error {
+	return d.withContext(context.Background(), func(col *mgo.Collection) error {
+		return mongoError("EnsureIndex", col.EnsureIndex(mgo.Index{Key: fields}))
+	})
+}
+func (d *mongoDriver) EnsureUniqueIndex(fields ...string) error {
+	return d.withContext(context.Background(), func(col *mgo.Collection) error {
+		return mongoError("EnsureUniqueIndex", col.EnsureIndex(mgo.Index{Key: fields, Unique: true}))
+	})
+}
+
+//Clone copies the session, the clone keeps the db and collection but has sockets of its own and is closed on its own
 func (d *mongoDriver) Clone() Meta {
-	var a = *d
-	return &a
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var a = &mongoDriver{}
+	if nil != d.session {
+		a.session = d.session.Copy()
+	}
+	if nil != d.db {
+		a.db = d.db.With(a.session)
+	}
+	if nil != d.col {
+		a.col = d.col.With(a.session)
+	}
+	return a
 }
 func (d *mongoDriver) Driver() (StorageDriver, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	if d.db == nil || d.col == nil || d.session == nil {
-		return nil, fmt.Errorf("db ,session or col cannot be nil")
+		return nil, ErrNoCollection
 	}
 	return d, nil
 }
 func (d *mongoDriver) AggregateMongo(doc []Document) ([]Document, error) {
 	var dc = make([]Document, 0)
-	err := d.col.Pipe(doc).All(&dc)
+	err := d.withContext(context.Background(), func(col *mgo.Collection) error {
+		return mongoError("AggregateMongo", col.Pipe(doc).All(&dc))
+	})
 	return dc, err
 }
 func (d *mongoDriver) Lt(Doc Document) Document {
-	var newDoc = make(Document)
-	for k, v := range Doc {
-		newDoc[k] = Document{"$lt": v}
-	}
-	return newDoc
+	return operatorDocument("$lt", Doc)
 }
 func (d *mongoDriver) Lte(Doc Document) Document {
-	var newDoc = make(Document)
-	for k, v := range Doc {
-		newDoc[k] = Document{"$lte": v}
-	}
-	return newDoc
+	return operatorDocument("$lte", Doc)
 }
 func (d *mongoDriver) Gte(Doc Document) Document {
-	var newDoc = make(Document)
-	for k, v := range Doc {
-		newDoc[k] = Document{"$gte": v}
-	}
-	return newDoc
+	return operatorDocument("$gte", Doc)
 }
 func (d *mongoDriver) Gt(Doc Document) Document {
-	var newDoc = make(Document)
-	for k, v := range Doc {
-		newDoc[k] = Document{"$gt": v}
-	}
-	return newDoc
+	return operatorDocument("$gt", Doc)
 }
 func (d *mongoDriver) In(key string, values []interface{}) Document {
 	return Document{key: Document{"$in": values}}
@@ -91,185 +131,300 @@ func (d *mongoDriver) Between(key string, values [2]interface{}) Document {
 	return Document{key: Document{"$gte": values[0], "$lte": values[1]}}
 }
 func (d *mongoDriver) Not(Doc Document) Document {
-	var newDoc = make(Document)
-	for k, v := range Doc {
-		newDoc[k] = Document{"$ne": v}
-	}
-	return newDoc
+	return operatorDocument("$ne", Doc)
 }
 func (d *mongoDriver) Regex(key, value string) Document {
 	return Document{key: Document{"$regex": value}}
 }
 func (d *mongoDriver) Cursor() Cursor {
-	d.cursor = new(crs)
-	d.cursor.and = bson.M{}
-	d.cursor.or = make([]interface{}, 0)
-	d.cursor.queue = make([]func(), 0)
-	return d
+	return crs{driver: d}
 }
-func (d *mongoDriver) And(Doc Document) Cursor {
+func (c crs) And(Doc Document) Cursor {
+	var and = make(bson.M, len(c.and)+len(Doc))
+	for k, v := range c.and {
+		and[k] = v
+	}
 	for k, v := range Doc {
-		d.cursor.and[k] = v
+		and[k] = v
 	}
-	return d
+	c.and = and
+	return c
 }
 
-func (d *mongoDriver) Or(Doc []interface{}) Cursor {
-	d.cursor.or = append(d.cursor.or, Doc...)
-	return d
+func (c crs) Where(Query Filter) Cursor {
+	q, err := FilterToDocument(Query)
+	if nil != err {
+		c.err = err
+		return c
+	}
+	c.where = append(c.where[:len(c.where):len(c.where)], q)
+	return c
+}
+
+func (c crs) Or(Doc []interface{}) Cursor {
+	c.or = append(c.or[:len(c.or):len(c.or)], Doc...)
+	return c
 }
 
-func (d *mongoDriver) Select(fields ...string) Cursor {
+func (c crs) Select(fields ...string) Cursor {
 	fieldMap := bson.M{"_id": 0}
 	for _, field := range fields {
 		fieldMap[field] = 1
 	}
-	fn := func() {
-		d.cursor.q.Select(fieldMap)
-	}
-	d.cursor.queue = append(d.cursor.queue, fn)
-	return d
+	return c.then(func(q *mgo.Query) { q.Select(fieldMap) })
 }
 
-func (d *mongoDriver) Sort(Doc ...string) Cursor {
-	fn := func() {
-		d.cursor.q.Sort(Doc...)
-	}
-	d.cursor.queue = append(d.cursor.queue, fn)
-	return d
+func (c crs) Sort(Doc ...string) Cursor {
+	var keys = append([]string(nil), Doc...)
+	return c.then(func(q *mgo.Query) { q.Sort(keys...) })
 }
 
-func (d *mongoDriver) Limit(num int) Cursor {
-	fn := func() {
-		d.cursor.q.Limit(num)
-	}
-	d.cursor.queue = append(d.cursor.queue, fn)
-	return d
+func (c crs) Limit(num int) Cursor {
+	return c.then(func(q *mgo.Query) { q.Limit(num) })
 }
 
-func (d *mongoDriver) Skip(num int) Cursor {
-	fn := func() {
-		d.cursor.q.Skip(num)
-	}
-	d.cursor.queue = append(d.cursor.queue, fn)
-	return d
+func (c crs) Skip(num int) Cursor {
+	return c.then(func(q *mgo.Query) { q.Skip(num) })
 }
 
-func (d *mongoDriver) One(Doc interface{}) error {
-	q := getQuery(d.cursor.and, d.cursor.or)
-	d.cursor.q = d.col.Find(q)
-	for _, fn := range d.cursor.queue {
-		fn()
-	}
-	return d.cursor.q.One(Doc)
+func (c crs) Batch(n int) Cursor {
+	return c.then(func(q *mgo.Query) { q.Batch(n) })
 }
 
-func (d *mongoDriver) Count(num *int) error {
-	q := getQuery(d.cursor.and, d.cursor.or)
-	d.cursor.q = d.col.Find(q)
-	for _, fn := range d.cursor.queue {
-		fn()
-	}
-	_num, err := d.cursor.q.Count()
-	*num = _num
-	return err
+func (c crs) Prefetch(p float64) Cursor {
+	return c.then(func(q *mgo.Query) { q.Prefetch(p) })
 }
 
-func (d *mongoDriver) All(Doc interface{}) error {
-	q := getQuery(d.cursor.and, d.cursor.or)
-	d.cursor.q = d.col.Find(q)
-	for _, fn := range d.cursor.queue {
-		fn()
+//Iter keeps a copy of the session until the iterator is exhausted or closed
+func (c crs) Iter() Iterator {
+	if nil != c.err {
+		return errIterator{c.err}
+	}
+	session, col, err := c.driver.copySession()
+	if nil != err {
+		return errIterator{err}
+	}
+	if nil == col {
+		session.Close()
+		return errIterator{ErrNoCollection}
 	}
-	return d.cursor.q.All(Doc)
+	q := col.With(session).Find(getQuery(c.and, c.or, c.where))
+	for _, apply := range c.queue {
+		apply(q)
+	}
+	return &mongoIter{session: session, iter: q.Iter()}
+}
+
+func (c crs) ForEach(fn func(Document) error) error {
+	return forEach(c.Iter(), fn)
 }
 
-func (d *mongoDriver) Distinct(key string, result interface{}) error {
-	q := getQuery(d.cursor.and, d.cursor.or)
-	d.cursor.q = d.col.Find(q)
-	for _, fn := range d.cursor.queue {
-		fn()
+//then returns a copy of the cursor applying fn to the query after the steps queued so far
+func (c crs) then(fn func(q *mgo.Query)) crs {
+	c.queue = append(c.queue[:len(c.queue):len(c.queue)], fn)
+	return c
+}
+
+//run builds the query of the cursor on a copy of the session and hands it to fn
+func (c crs) run(fn func(q *mgo.Query) error) error {
+	if nil != c.err {
+		return c.err
 	}
-	return d.cursor.q.Distinct(key, result)
+	return c.driver.withContext(context.Background(), func(col *mgo.Collection) error {
+		q := col.Find(getQuery(c.and, c.or, c.where))
+		for _, apply := range c.queue {
+			apply(q)
+		}
+		return fn(q)
+	})
+}
+
+func (c crs) One(Doc interface{}) error {
+	return c.run(func(q *mgo.Query) error {
+		return mongoError("One", q.One(Doc))
+	})
+}
+
+func (c crs) Count(num *int) error {
+	return c.run(func(q *mgo.Query) error {
+		_num, err := q.Count()
+		*num = _num
+		return mongoError("Count", err)
+	})
+}
+
+func (c crs) All(Doc interface{}) error {
+	return c.run(func(q *mgo.Query) error {
+		return mongoError("All", q.All(Doc))
+	})
 }
 
+func (c crs) Distinct(key string, result interface{}) error {
+	return c.run(func(q *mgo.Query) error {
+		return mongoError("Distinct", q.Distinct(key, result))
+	})
+}
+
+//the methods without a context run on a copy of the session like their Ctx variants
 func (d *mongoDriver) Save(Query, Doc Document) error {
-	_, err := d.col.Upsert(Query, Document{"$set": Doc})
-	return err
+	return d.SaveCtx(context.Background(), Query, Doc)
 }
 func (d *mongoDriver) Get(query Document) ([]Document, error) {
-	var docs = make([]Document, 0)
-	err := d.col.Find(query).All(&docs)
-	return docs, err
+	return d.GetCtx(context.Background(), query)
 }
 func (d *mongoDriver) GetOne(query Document) (Document, error) {
-	var doc = make(Document)
-	err := d.col.Find(query).One(&doc)
-	return doc, err
+	return d.GetOneCtx(context.Background(), query)
+}
+func (d *mongoDriver) Find(Query Filter) ([]Document, error) {
+	q, err := FilterToDocument(Query)
+	if nil != err {
+		return nil, err
+	}
+	return d.Get(q)
+}
+func (d *mongoDriver) FindOne(Query Filter) (Document, error) {
+	q, err := FilterToDocument(Query)
+	if nil != err {
+		return nil, err
+	}
+	return d.GetOne(q)
 }
 func (d *mongoDriver) Custom(query interface{}) ([]Document, error) {
-	return nil, fmt.Errorf("not implemented")
+	return nil, ErrNotImplemented
 }
 func (d *mongoDriver) Update(query, updateFields Document) error {
-	return d.col.Update(query, Document{"$set": updateFields})
+	return d.UpdateCtx(context.Background(), query, updateFields)
 }
 func (d *mongoDriver) UpdateMulti(query, updateFields Document) (int, error) {
-	info, err := d.col.UpdateAll(query, Document{"$set": updateFields})
-	if nil != info {
-		return info.Updated, err
-	}
-	return 0, err
+	return d.UpdateMultiCtx(context.Background(), query, updateFields)
+}
+func (d *mongoDriver) UpdateWith(query Document, change *Update) error {
+	return d.UpdateWithCtx(context.Background(), query, change)
+}
+func (d *mongoDriver) UpdateMultiWith(query Document, change *Update) (int, error) {
+	return d.UpdateMultiWithCtx(context.Background(), query, change)
+}
+func (d *mongoDriver) SaveWith(query Document, change *Update) error {
+	return d.SaveWithCtx(context.Background(), query, change)
+}
+func (d *mongoDriver) RemoveMulti(query Document) (int, error) {
+	return d.RemoveMultiCtx(context.Background(), query)
+}
+func (d *mongoDriver) FindAndUpdate(query Document, change *Update, opts FindAndUpdateOptions) (Document, error) {
+	return d.FindAndUpdateCtx(context.Background(), query, change, opts)
+}
+func (d *mongoDriver) FindAndRemove(query Document) (Document, error) {
+	return d.FindAndRemoveCtx(context.Background(), query)
 }
 func (d *mongoDriver) Insert(Doc Document) error {
-	return d.col.Insert(Doc)
+	return d.InsertCtx(context.Background(), Doc)
+}
+func (d *mongoDriver) InsertWithID(Doc Document) (interface{}, error) {
+	return d.InsertWithIDCtx(context.Background(), Doc)
 }
 func (d *mongoDriver) InsertMulti(docs []Document) error {
-	var dcs = make([]interface{}, len(docs))
-	for i := range docs {
-		dcs[i] = docs[i]
-	}
-	return d.col.Insert(dcs...)
+	return d.InsertMultiCtx(context.Background(), docs)
 }
 func (d *mongoDriver) InsertMultiNoFail(docs []Document, ErrorOut ...io.Writer) []error {
-	var errs = make([]error, 0)
-	for _, doc := range docs {
-		if err := d.col.Insert(doc); nil != err {
-			errs = append(errs, err)
-			if len(ErrorOut) > 0 {
-				ErrorOut[0].Write([]byte(err.Error()))
-			}
-		}
-	}
-	return errs
+	return d.InsertMultiNoFailCtx(context.Background(), docs, ErrorOut...)
 }
 func (d *mongoDriver) Remove(query Document) error {
-	return d.col.Remove(query)
+	return d.RemoveCtx(context.Background(), query)
 }
+
+//NewMongoDriver dials a mongodb:// or mongodb+srv:// connection string, any other scheme or a bare host is refused
+//although earlier versions took them.
+//Seed hosts, credentials and the replicaSet, authSource, authMechanism, ssl, tls, readPreference, w, wtimeoutMS, journal,
+//maxPoolSize, connectTimeoutMS and socketTimeoutMS options are applied, the database of the path is selected.
+//A connection string that cannot be used gives a *URIError, a failed dial names the uri without its password
 func NewMongoDriver(addr string) (Meta, error) {
-	adrs, err := url.Parse(addr)
+	uri, err := parseMongoURI(addr)
 	if nil != err {
 		return nil, err
 	}
-	if adrs.Host == "" {
-		return nil, fmt.Errorf("invalid host")
-	}
-	var fullAddr = adrs.Hostname() + ":" + adrs.Port()
-	if nil != adrs.User {
-		usr := adrs.User
-		fullAddr = usr.String() + "@" + fullAddr
-	}
-
-	session, err := mgo.DialWithTimeout(fullAddr, time.Second*5)
+	session, err := uri.dial(addr)
 	if nil != err {
 		return nil, err
 	}
-	return &mongoDriver{
+	var driver = &mongoDriver{
 		session: session,
-	}, nil
+	}
+	if uri.info.Database != "" {
+		driver.DB(uri.info.Database)
+	}
+	return driver, nil
+}
+
+//mongoError maps mgo errors onto the error kinds of the package keeping the original error as the cause
+func mongoError(op string, err error) error {
+	if nil == err {
+		return nil
+	}
+	var kind error
+	switch {
+	case err == mgo.ErrNotFound:
+		kind = ErrNotFound
+	case mgo.IsDup(err):
+		kind = ErrDuplicateKey
+	case mongoErrorCode(err) == 66:
+		kind = ErrImmutableID
+	}
+	return &DriverError{Driver: "mongo", Op: op, Kind: kind, Err: err}
+}
+
+//mongoErrorCode returns the server error code of err, 66 is ImmutableField
+func mongoErrorCode(err error) int {
+	switch e := err.(type) {
+	case *mgo.LastError:
+		return e.Code
+	case *mgo.QueryError:
+		return e.Code
+	}
+	return 0
+}
+
+type mongoIter struct {
+	session *mgo.Session
+	iter    *mgo.Iter
+	err     error
+}
+
+func (it *mongoIter) Next(doc interface{}) bool {
+	if nil == it.session {
+		return false
+	}
+	if it.iter.Next(doc) {
+		return true
+	}
+	it.Close()
+	return false
+}
+func (it *mongoIter) Err() error {
+	if nil == it.session {
+		return it.err
+	}
+	return mongoError("Iter", it.iter.Err())
+}
+func (it *mongoIter) Close() error {
+	if nil != it.session {
+		it.err = mongoError("Iter", it.iter.Close())
+		it.session.Close()
+		it.session = nil
+	}
+	return it.err
 }
-func getQuery(and Document, or []interface{}) Document {
+
+//getQuery builds a new query document, the maps and slices of the cursor are left untouched
+func getQuery(and bson.M, or []interface{}, where []interface{}) Document {
+	var q = make(Document, len(and)+2)
+	for k, v := range and {
+		q[k] = v
+	}
 	if len(or) > 0 {
-		and["$or"] = or
+		q["$or"] = or
+	}
+	if len(where) > 0 {
+		q["$and"] = where
 	}
-	return and
+	return q
 }
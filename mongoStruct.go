@@ -0,0 +1,81 @@
+package storageDriver
+
+import (
+	"context"
+	"reflect"
+
+	"gopkg.in/mgo.v2"
+)
+
+//the struct methods hand the values to mgo as they are, bson reads the same tags ToDocument does
+
+func (d *mongoDriver) InsertStruct(Doc interface{}) error {
+	return d.InsertStructCtx(context.Background(), Doc)
+}
+func (d *mongoDriver) InsertStructCtx(ctx context.Context, Doc interface{}) error {
+	if err := checkDocumentIn(Doc); nil != err {
+		return err
+	}
+	return d.withContext(ctx, func(col *mgo.Collection) error {
+		return mongoError("InsertStruct", col.Insert(Doc))
+	})
+}
+func (d *mongoDriver) SaveStruct(Query Document, Doc interface{}) error {
+	return d.SaveStructCtx(context.Background(), Query, Doc)
+}
+func (d *mongoDriver) SaveStructCtx(ctx context.Context, Query Document, Doc interface{}) error {
+	if err := checkDocumentIn(Doc); nil != err {
+		return err
+	}
+	return d.withContext(ctx, func(col *mgo.Collection) error {
+		_, err := col.Upsert(Query, Document{"$set": Doc})
+		return mongoError("SaveStruct", err)
+	})
+}
+func (d *mongoDriver) UpdateStruct(Query Document, Doc interface{}) error {
+	return d.UpdateStructCtx(context.Background(), Query, Doc)
+}
+func (d *mongoDriver) UpdateStructCtx(ctx context.Context, Query Document, Doc interface{}) error {
+	if err := checkDocumentIn(Doc); nil != err {
+		return err
+	}
+	return d.withContext(ctx, func(col *mgo.Collection) error {
+		return mongoError("UpdateStruct", col.Update(Query, Document{"$set": Doc}))
+	})
+}
+func (d *mongoDriver) GetInto(Query Document, Out interface{}) error {
+	return d.GetIntoCtx(context.Background(), Query, Out)
+}
+
+//GetIntoCtx decodes into a value of its own and sets Out once mgo is done with it, a done ctx leaves Out as it is
+func (d *mongoDriver) GetIntoCtx(ctx context.Context, Query Document, Out interface{}) error {
+	if err := checkSliceOut(Out); nil != err {
+		return err
+	}
+	out, err := withResult(ctx, d, func(col *mgo.Collection) (reflect.Value, error) {
+		out := reflect.New(reflect.TypeOf(Out).Elem())
+		return out, mongoError("GetInto", withMaxTime(ctx, col.Find(Query)).All(out.Interface()))
+	})
+	if nil != err {
+		return err
+	}
+	reflect.ValueOf(Out).Elem().Set(out.Elem())
+	return nil
+}
+func (d *mongoDriver) GetOneInto(Query Document, Out interface{}) error {
+	return d.GetOneIntoCtx(context.Background(), Query, Out)
+}
+func (d *mongoDriver) GetOneIntoCtx(ctx context.Context, Query Document, Out interface{}) error {
+	if err := checkOut(Out); nil != err {
+		return err
+	}
+	out, err := withResult(ctx, d, func(col *mgo.Collection) (reflect.Value, error) {
+		out := reflect.New(reflect.TypeOf(Out).Elem())
+		return out, mongoError("GetOneInto", withMaxTime(ctx, col.Find(Query)).One(out.Interface()))
+	})
+	if nil != err {
+		return err
+	}
+	reflect.ValueOf(Out).Elem().Set(out.Elem())
+	return nil
+}
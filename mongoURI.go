@@ -0,0 +1,334 @@
+package storageDriver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+const mongoDefaultPort = "27017"
+
+//mongoDialTimeout is used unless the uri gives connectTimeoutMS
+const mongoDialTimeout = 5 * time.Second
+
+//resolvers of mongodb+srv uris, replaced in tests
+var (
+	lookupSRV = net.LookupSRV
+	lookupTXT = net.LookupTXT
+)
+
+//URIError reports a connection string NewMongoDriver cannot use, Option is empty when the error is not about an option
+type URIError struct {
+	Option string
+	Value  string
+	Reason string
+}
+
+func (e *URIError) Error() string {
+	if e.Option == "" {
+		return "invalid mongodb uri: " + e.Reason
+	}
+	return fmt.Sprintf("invalid mongodb uri option %s=%s: %s", e.Option, e.Value, e.Reason)
+}
+
+//mongoURI is a parsed connection string, the settings mgo takes after dialing are kept next to the DialInfo
+type mongoURI struct {
+	info           *mgo.DialInfo
+	ssl            bool
+	mode           mgo.Mode
+	hasMode        bool
+	safe           mgo.Safe
+	hasSafe        bool
+	unacknowledged bool
+	socketTimeout  time.Duration
+}
+
+//parseMongoURI follows https://docs.mongodb.com/manual/reference/connection-string/ for the options mgo supports
+func parseMongoURI(addr string) (*mongoURI, error) {
+	var rest string
+	var srv bool
+	switch {
+	case strings.HasPrefix(addr, "mongodb://"):
+		rest = addr[len("mongodb://"):]
+	case strings.HasPrefix(addr, "mongodb+srv://"):
+		rest, srv = addr[len("mongodb+srv://"):], true
+	default:
+		return nil, &URIError{Reason: "the scheme is supposed to be mongodb:// or mongodb+srv://"}
+	}
+	var rawQuery, path string
+	if i := strings.Index(rest, "?"); i >= 0 {
+		rest, rawQuery = rest[:i], rest[i+1:]
+	}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, path = rest[:i], rest[i+1:]
+	}
+	var uri = &mongoURI{info: &mgo.DialInfo{Timeout: mongoDialTimeout}}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		if err := uri.parseUserInfo(rest[:i]); nil != err {
+			return nil, err
+		}
+		rest = rest[i+1:]
+	}
+	db, err := url.PathUnescape(path)
+	if nil != err || strings.ContainsAny(db, "/\\. \"$") {
+		return nil, &URIError{Reason: fmt.Sprintf("invalid database name %q", path)}
+	}
+	uri.info.Database = db
+
+	var options = make(map[string][2]string)
+	if srv {
+		uri.ssl = true
+		if err := uri.resolveSRV(rest, options); nil != err {
+			return nil, err
+		}
+	} else if err := uri.parseHosts(rest); nil != err {
+		return nil, err
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if nil != err {
+		return nil, &URIError{Reason: "malformed options: " + err.Error()}
+	}
+	for key, values := range query {
+		options[strings.ToLower(key)] = [2]string{key, values[len(values)-1]}
+	}
+	var keys = make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := uri.applyOption(key, options[key][0], options[key][1]); nil != err {
+			return nil, err
+		}
+	}
+	if uri.ssl {
+		timeout := uri.info.Timeout
+		uri.info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			host, _, _ := net.SplitHostPort(addr.String())
+			return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr.String(), &tls.Config{ServerName: host})
+		}
+	}
+	return uri, nil
+}
+
+func (uri *mongoURI) parseUserInfo(userinfo string) error {
+	user, password := userinfo, ""
+	if i := strings.Index(userinfo, ":"); i >= 0 {
+		user, password = userinfo[:i], userinfo[i+1:]
+	}
+	var err error
+	if uri.info.Username, err = url.PathUnescape(user); nil != err || uri.info.Username == "" {
+		return &URIError{Reason: "invalid username"}
+	}
+	if uri.info.Password, err = url.PathUnescape(password); nil != err {
+		return &URIError{Reason: "invalid password"}
+	}
+	return nil
+}
+
+func (uri *mongoURI) parseHosts(hosts string) error {
+	for _, host := range strings.Split(hosts, ",") {
+		if host == "" {
+			return &URIError{Reason: "missing host"}
+		}
+		if _, port, err := net.SplitHostPort(host); nil != err {
+			if strings.HasSuffix(host, "]") || !strings.Contains(host, ":") {
+				host = net.JoinHostPort(strings.Trim(host, "[]"), mongoDefaultPort)
+			} else {
+				return &URIError{Reason: fmt.Sprintf("invalid host %q", host)}
+			}
+		} else if n, err := strconv.Atoi(port); nil != err || n <= 0 || n > 65535 {
+			return &URIError{Reason: fmt.Sprintf("invalid port in %q", host)}
+		}
+		uri.info.Addrs = append(uri.info.Addrs, host)
+	}
+	return nil
+}
+
+//resolveSRV turns the host of a mongodb+srv uri into seed hosts, its TXT record may give authSource and replicaSet
+func (uri *mongoURI) resolveSRV(host string, options map[string][2]string) error {
+	if host == "" || strings.ContainsAny(host, ",:") {
+		return &URIError{Reason: "mongodb+srv takes a single host without a port"}
+	}
+	_, records, err := lookupSRV("mongodb", "tcp", host)
+	if nil != err {
+		return &URIError{Reason: fmt.Sprintf("cannot resolve %s: %v", host, err)}
+	}
+	if len(records) == 0 {
+		return &URIError{Reason: fmt.Sprintf("no SRV records for %s", host)}
+	}
+	for _, record := range records {
+		uri.info.Addrs = append(uri.info.Addrs, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+	}
+	txt, err := lookupTXT(host)
+	if nil != err {
+		//a missing TXT record is allowed
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil
+		}
+		return &URIError{Reason: fmt.Sprintf("cannot resolve the TXT record of %s: %v", host, err)}
+	}
+	if len(txt) > 1 {
+		return &URIError{Reason: fmt.Sprintf("%s has more than one TXT record", host)}
+	}
+	if len(txt) == 0 {
+		return nil
+	}
+	query, err := url.ParseQuery(txt[0])
+	if nil != err {
+		return &URIError{Reason: "malformed TXT record: " + err.Error()}
+	}
+	for key, values := range query {
+		switch strings.ToLower(key) {
+		case "authsource", "replicaset":
+			options[strings.ToLower(key)] = [2]string{key, values[len(values)-1]}
+		default:
+			return &URIError{Option: key, Value: values[0], Reason: "not allowed in a TXT record"}
+		}
+	}
+	return nil
+}
+
+func (uri *mongoURI) applyOption(key, name, value string) error {
+	var invalid = func(reason string) error {
+		return &URIError{Option: name, Value: value, Reason: reason}
+	}
+	var number = func() (int, error) {
+		n, err := strconv.Atoi(value)
+		if nil != err || n < 0 {
+			return 0, invalid("not a positive number")
+		}
+		return n, nil
+	}
+	switch key {
+	case "replicaset":
+		uri.info.ReplicaSetName = value
+	case "authsource":
+		uri.info.Source = value
+	case "authmechanism":
+		uri.info.Mechanism = value
+	case "ssl", "tls":
+		ssl, err := strconv.ParseBool(value)
+		if nil != err {
+			return invalid("not a boolean")
+		}
+		uri.ssl = ssl
+	case "readpreference":
+		modes := map[string]mgo.Mode{
+			"primary":            mgo.Primary,
+			"primarypreferred":   mgo.PrimaryPreferred,
+			"secondary":          mgo.Secondary,
+			"secondarypreferred": mgo.SecondaryPreferred,
+			"nearest":            mgo.Nearest,
+		}
+		mode, ok := modes[strings.ToLower(value)]
+		if !ok {
+			return invalid("unknown read preference")
+		}
+		uri.mode, uri.hasMode = mode, true
+	case "w":
+		uri.hasSafe = true
+		if n, err := strconv.Atoi(value); nil == err {
+			if n < 0 {
+				return invalid("negative write concern")
+			}
+			uri.safe.W, uri.unacknowledged = n, n == 0
+		} else if value == "" {
+			return invalid("empty write concern")
+		} else {
+			uri.safe.WMode = value
+		}
+	case "wtimeoutms":
+		n, err := number()
+		if nil != err {
+			return err
+		}
+		uri.safe.WTimeout, uri.hasSafe = n, true
+	case "journal":
+		j, err := strconv.ParseBool(value)
+		if nil != err {
+			return invalid("not a boolean")
+		}
+		uri.safe.J, uri.hasSafe = j, true
+	case "maxpoolsize":
+		n, err := number()
+		if nil != err {
+			return err
+		}
+		uri.info.PoolLimit = n
+	case "connecttimeoutms":
+		n, err := number()
+		if nil != err {
+			return err
+		}
+		if n > 0 {
+			uri.info.Timeout = time.Duration(n) * time.Millisecond
+		}
+	case "sockettimeoutms":
+		n, err := number()
+		if nil != err {
+			return err
+		}
+		uri.socketTimeout = time.Duration(n) * time.Millisecond
+	case "appname", "retrywrites":
+		//accepted for compatibility with the uris of other drivers, mgo has no use for them
+	default:
+		return invalid("unknown option")
+	}
+	return nil
+}
+
+//redactMongoURI returns addr with the password replaced so it can go into errors and logs
+func redactMongoURI(addr string) string {
+	var scheme = "mongodb://"
+	if strings.HasPrefix(addr, "mongodb+srv://") {
+		scheme = "mongodb+srv://"
+	}
+	rest := strings.TrimPrefix(addr, scheme)
+	host := rest
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		host = rest[:i]
+	}
+	at := strings.LastIndex(host, "@")
+	if at < 0 {
+		return addr
+	}
+	user := host[:at]
+	if i := strings.Index(user, ":"); i >= 0 {
+		user = user[:i] + ":xxxxx"
+	}
+	return scheme + user + rest[at:]
+}
+
+//dial connects and applies the settings mgo only takes on a session, addr only names the server in the error
+func (uri *mongoURI) dial(addr string) (*mgo.Session, error) {
+	session, err := mgo.DialWithInfo(uri.info)
+	if nil != err {
+		return nil, fmt.Errorf("cannot connect to %s: %w", redactMongoURI(addr), err)
+	}
+	if uri.hasMode {
+		session.SetMode(uri.mode, true)
+	}
+	if uri.hasSafe {
+		safe := uri.safe
+		if uri.unacknowledged {
+			session.SetSafe(nil)
+		} else {
+			if safe.W == 0 && safe.WMode == "" {
+				safe.W = 1
+			}
+			session.SetSafe(&safe)
+		}
+	}
+	if uri.socketTimeout > 0 {
+		session.SetSocketTimeout(uri.socketTimeout)
+	}
+	return session, nil
+}
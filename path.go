@@ -0,0 +1,267 @@
+package storageDriver
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//pathValues holds the values a dotted path reached by fanning out over an array of documents.
+//The matcher treats it like mongodb does, a condition holds when it holds for one of the values
+type pathValues []interface{}
+
+//lookupPath resolves a dotted path like "address.city" or "items.0.qty" against doc for queries.
+//A numeric part indexes an array, any other part applied to an array fans out over the documents in it
+//and the values reached are returned as pathValues. exists is false when the path reaches nothing
+func lookupPath(doc Document, path string) (interface{}, bool) {
+	if !strings.Contains(path, ".") {
+		v, ok := doc[path]
+		return v, ok
+	}
+	return lookupSegments(doc, strings.Split(path, "."))
+}
+
+func lookupSegments(value interface{}, segments []string) (interface{}, bool) {
+	if len(segments) == 0 {
+		return value, true
+	}
+	if doc, ok := toDocument(value); ok {
+		v, ok := doc[segments[0]]
+		if !ok {
+			return nil, false
+		}
+		return lookupSegments(v, segments[1:])
+	}
+	array := toSlice(value)
+	if nil == array {
+		return nil, false
+	}
+	if i, ok := arrayIndex(segments[0]); ok {
+		if i >= len(array) {
+			return nil, false
+		}
+		return lookupSegments(array[i], segments[1:])
+	}
+	var values pathValues
+	var exists bool
+	for _, elem := range array {
+		if _, ok := toDocument(elem); !ok {
+			continue
+		}
+		v, ok := lookupSegments(elem, segments)
+		if !ok {
+			continue
+		}
+		exists = true
+		if nested, ok := v.(pathValues); ok {
+			values = append(values, nested...)
+		} else {
+			values = append(values, v)
+		}
+	}
+	return values, exists
+}
+
+//pathValue is lookupPath for expressions and sorting, the values of a fan out are returned as an array
+func pathValue(doc Document, path string) interface{} {
+	v, _ := lookupPath(doc, path)
+	if values, ok := v.(pathValues); ok {
+		return []interface{}(values)
+	}
+	return v
+}
+
+//getPath returns the single value at a dotted path for updates, it never fans out over arrays
+func getPath(doc Document, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, segment := range strings.Split(path, ".") {
+		if sub, ok := toDocument(current); ok {
+			if current, ok = sub[segment]; !ok {
+				return nil, false
+			}
+			continue
+		}
+		array := toSlice(current)
+		i, ok := arrayIndex(segment)
+		if nil == array || !ok || i >= len(array) {
+			return nil, false
+		}
+		current = array[i]
+	}
+	return current, true
+}
+
+//setPath sets the value at a dotted path of doc creating the missing documents, an array is padded with nil
+//up to a numeric part. The documents and arrays along the path are copied, doc may share them with a stored document
+func setPath(doc Document, path string, value interface{}) error {
+	return changePath(doc, strings.Split(path, "."), path, value, false)
+}
+
+//unsetPath removes the field at a dotted path of doc, an array element is set to nil instead like mongodb does
+func unsetPath(doc Document, path string) error {
+	return changePath(doc, strings.Split(path, "."), path, nil, true)
+}
+
+func changePath(doc Document, segments []string, path string, value interface{}, unset bool) error {
+	key := segments[0]
+	if len(segments) == 1 {
+		if unset {
+			delete(doc, key)
+		} else {
+			doc[key] = value
+		}
+		return nil
+	}
+	child, exists := doc[key]
+	if !exists || nil == child {
+		if unset {
+			return nil
+		}
+		child = Document{}
+	}
+	child, err := changeChild(child, segments[1:], path, value, unset)
+	if nil != err {
+		return err
+	}
+	doc[key] = child
+	return nil
+}
+
+//changeChild returns a copy of child, a document or an array, with the change made at segments
+func changeChild(child interface{}, segments []string, path string, value interface{}, unset bool) (interface{}, error) {
+	if sub, ok := toDocument(child); ok {
+		var cpy = shallowCopy(sub)
+		return cpy, changePath(cpy, segments, path, value, unset)
+	}
+	array := toSlice(child)
+	if nil == array {
+		return nil, fmt.Errorf("cannot create the field %s of %s in a %T", segments[0], path, child)
+	}
+	i, ok := arrayIndex(segments[0])
+	if !ok {
+		return nil, fmt.Errorf("cannot use the part %s of %s to traverse an array", segments[0], path)
+	}
+	if unset && i >= len(array) {
+		return child, nil
+	}
+	var cpy = append(make([]interface{}, 0, len(array)), array...)
+	for len(cpy) <= i {
+		cpy = append(cpy, nil)
+	}
+	if len(segments) == 1 {
+		cpy[i] = value
+		return cpy, nil
+	}
+	elem := cpy[i]
+	if nil == elem {
+		if unset {
+			return child, nil
+		}
+		elem = Document{}
+	}
+	elem, err := changeChild(elem, segments[1:], path, value, unset)
+	if nil != err {
+		return nil, err
+	}
+	cpy[i] = elem
+	return cpy, nil
+}
+
+//projectPath copies the value at segments from src into dst keeping the nesting,
+//arrays of documents are projected element by element and their other elements are dropped like mongodb does.
+//A field already projected whole covers the paths under it, src is never changed
+func projectPath(dst, src Document, segments []string) {
+	v, ok := src[segments[0]]
+	if !ok {
+		return
+	}
+	if len(segments) == 1 {
+		dst[segments[0]] = v
+		return
+	}
+	if prev, ok := dst[segments[0]]; ok && sameValue(prev, v) {
+		return
+	}
+	if sub, ok := toDocument(v); ok {
+		var target = Document{}
+		if prev, ok := toDocument(dst[segments[0]]); ok {
+			target = shallowCopy(prev)
+		}
+		projectPath(target, sub, segments[1:])
+		dst[segments[0]] = target
+		return
+	}
+	array := toSlice(v)
+	if nil == array {
+		return
+	}
+	//existing holds the documents projected by an earlier path, one for each document of the array
+	existing := toSlice(dst[segments[0]])
+	var projected = make([]interface{}, 0, len(array))
+	for _, elem := range array {
+		sub, ok := toDocument(elem)
+		if !ok {
+			continue
+		}
+		var target = Document{}
+		if len(projected) < len(existing) {
+			if prev, ok := toDocument(existing[len(projected)]); ok {
+				target = shallowCopy(prev)
+			}
+		}
+		projectPath(target, sub, segments[1:])
+		projected = append(projected, target)
+	}
+	dst[segments[0]] = projected
+}
+
+//excludePath removes the field at segments from dst, arrays of documents lose it in every document like mongodb does.
+//The documents and arrays along the path are copied, dst may share them with a stored document
+func excludePath(dst Document, segments []string) {
+	v, ok := dst[segments[0]]
+	if !ok {
+		return
+	}
+	if len(segments) == 1 {
+		delete(dst, segments[0])
+		return
+	}
+	if sub, ok := toDocument(v); ok {
+		var cpy = shallowCopy(sub)
+		excludePath(cpy, segments[1:])
+		dst[segments[0]] = cpy
+		return
+	}
+	array := toSlice(v)
+	if nil == array {
+		return
+	}
+	var cpy = make([]interface{}, len(array))
+	for i, elem := range array {
+		cpy[i] = elem
+		if sub, ok := toDocument(elem); ok {
+			var target = shallowCopy(sub)
+			excludePath(target, segments[1:])
+			cpy[i] = target
+		}
+	}
+	dst[segments[0]] = cpy
+}
+
+//sameValue reports whether a and b are the same map or slice, not just equal ones
+func sameValue(a, b interface{}) bool {
+	ra, rb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if ra.Kind() != rb.Kind() || (ra.Kind() != reflect.Map && ra.Kind() != reflect.Slice) {
+		return false
+	}
+	return ra.Pointer() == rb.Pointer() && ra.Len() == rb.Len()
+}
+
+func arrayIndex(segment string) (int, bool) {
+	if segment == "" || segment[0] < '0' || segment[0] > '9' {
+		return 0, false
+	}
+	i, err := strconv.Atoi(segment)
+	return i, nil == err
+}
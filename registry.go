@@ -0,0 +1,123 @@
+package storageDriver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Factory creates a driver for an url whose scheme it was registered with.
+//The path of the url is applied by Open afterwards, factories do not need to handle it
+type Factory func(u *url.URL) (Meta, error)
+
+var registry = struct {
+	sync.RWMutex
+	factories map[string]Factory
+}{factories: make(map[string]Factory)}
+
+//Register makes a driver available to Open under scheme.
+//It panics if factory is nil or the scheme is already registered, like database/sql does
+func Register(scheme string, factory Factory) {
+	scheme = strings.ToLower(scheme)
+	registry.Lock()
+	defer registry.Unlock()
+	if nil == factory {
+		panic("storageDriver: Register factory is nil")
+	}
+	if _, dup := registry.factories[scheme]; dup {
+		panic("storageDriver: Register called twice for scheme " + scheme)
+	}
+	registry.factories[scheme] = factory
+}
+
+//Drivers returns the sorted list of the registered schemes
+func Drivers() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	var schemes = make([]string, 0, len(registry.factories))
+	for scheme := range registry.factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+//Open creates the driver registered for the scheme of rawurl.
+//A path of the form /db or /db/collection is applied through DB and Table, the driver is closed if they fail
+func Open(rawurl string) (Meta, error) {
+	u, err := url.Parse(rawurl)
+	if nil != err {
+		return nil, err
+	}
+	registry.RLock()
+	factory, ok := registry.factories[strings.ToLower(u.Scheme)]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storageDriver: unknown driver %q (forgotten import?)", u.Scheme)
+	}
+	var path []string
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		path = strings.Split(p, "/")
+	}
+	if len(path) > 2 {
+		return nil, fmt.Errorf("storageDriver: the path of %s is supposed to be /db/collection", rawurl)
+	}
+	meta, err := factory(u)
+	if nil != err {
+		return nil, err
+	}
+	if len(path) > 0 {
+		if err := meta.DB(path[0]); nil != err {
+			meta.Close()
+			return nil, err
+		}
+	}
+	if len(path) > 1 {
+		if err := meta.Table(path[1]); nil != err {
+			meta.Close()
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+func init() {
+	//the path of a mongodb uri names the database only, Open selects the collection
+	var mongo = func(u *url.URL) (Meta, error) {
+		var uri = *u
+		if p := strings.Trim(uri.Path, "/"); p != "" {
+			uri.Path = "/" + strings.SplitN(p, "/", 2)[0]
+			uri.RawPath = ""
+		}
+		return NewMongoDriver(uri.String())
+	}
+	Register("mongodb", mongo)
+	Register("mongodb+srv", mongo)
+	//mem:///db/collection keeps everything in memory, mem:///db/collection?dir=/var/lib/app persists it with WithPersistence.
+	//snapshot sets the snapshot interval of a persistent driver, 0 disables scheduled snapshots
+	Register("mem", func(u *url.URL) (Meta, error) {
+		if u.Host != "" {
+			return nil, fmt.Errorf("storageDriver: mem urls have no host, use mem:///db/collection")
+		}
+		var options []MapOption
+		if interval := u.Query().Get("snapshot"); interval != "" {
+			d, err := time.ParseDuration(interval)
+			if nil != err {
+				return nil, fmt.Errorf("storageDriver: invalid snapshot interval: %v", err)
+			}
+			options = append(options, SnapshotInterval(d))
+		}
+		if dir := u.Query().Get("dir"); dir != "" {
+			options = append(options, WithPersistence(dir))
+		}
+		var meta = NewMapDriver(options...)
+		if err := meta.Ping(context.Background()); nil != err {
+			return nil, err
+		}
+		return meta, nil
+	})
+}
@@ -0,0 +1,159 @@
+package storageDriver
+
+//Repository stores values of T through a StorageDriver so domain code never handles Documents,
+//values are mapped with ToDocument and FromDocument whichever driver is underneath.
+//A value is identified by its _id field unless RepositoryID says otherwise
+type Repository[T any] struct {
+	driver StorageDriver
+	field  string
+	id     func(T) (interface{}, error)
+}
+
+//RepositoryOption configures a Repository created by NewRepository
+type RepositoryOption[T any] func(*Repository[T])
+
+//RepositoryID makes the repository identify values by field, id extracts the value of field from a T
+func RepositoryID[T any](field string, id func(T) interface{}) RepositoryOption[T] {
+	return func(r *Repository[T]) {
+		r.field = field
+		r.id = func(v T) (interface{}, error) { return id(v), nil }
+	}
+}
+
+//NewRepository returns a Repository of T on driver
+func NewRepository[T any](driver StorageDriver, options ...RepositoryOption[T]) *Repository[T] {
+	var r = &Repository[T]{driver: driver, field: "_id", id: documentID[T]}
+	for _, option := range options {
+		option(r)
+	}
+	return r
+}
+
+//documentID reads the _id of the document v is stored as
+func documentID[T any](v T) (interface{}, error) {
+	doc, err := ToDocument(v)
+	if nil != err {
+		return nil, err
+	}
+	id, ok := doc["_id"]
+	if !ok {
+		return nil, ErrNoID
+	}
+	return id, nil
+}
+
+//ID returns the id of v
+func (r *Repository[T]) ID(v T) (interface{}, error) {
+	id, err := r.id(v)
+	if nil == err && nil == id {
+		err = ErrNoID
+	}
+	return id, err
+}
+
+func (r *Repository[T]) Insert(v T) error {
+	return r.driver.InsertStruct(v)
+}
+
+//Get returns the value whose id is id
+func (r *Repository[T]) Get(id interface{}) (T, error) {
+	return r.FindOne(Eq(r.field, id))
+}
+func (r *Repository[T]) FindOne(filter Filter) (T, error) {
+	var v T
+	doc, err := r.driver.FindOne(filter)
+	if nil != err {
+		return v, err
+	}
+	err = FromDocument(doc, &v)
+	return v, err
+}
+
+//Find returns every value matching filter, no match gives an empty slice and no error
+func (r *Repository[T]) Find(filter Filter) ([]T, error) {
+	docs, err := r.driver.Find(filter)
+	if nil != err {
+		return nil, err
+	}
+	var values = make([]T, 0, len(docs))
+	err = DecodeDocuments(docs, &values)
+	return values, err
+}
+
+//Update overwrites the stored fields of the value with the id of v
+func (r *Repository[T]) Update(v T) error {
+	id, err := r.ID(v)
+	if nil != err {
+		return err
+	}
+	return r.driver.UpdateStruct(Document{r.field: id}, v)
+}
+
+//Save is Update inserting v when nothing has its id yet
+func (r *Repository[T]) Save(v T) error {
+	id, err := r.ID(v)
+	if nil != err {
+		return err
+	}
+	return r.driver.SaveStruct(Document{r.field: id}, v)
+}
+
+//Delete removes the value with the id of v
+func (r *Repository[T]) Delete(v T) error {
+	id, err := r.ID(v)
+	if nil != err {
+		return err
+	}
+	return r.driver.Remove(Document{r.field: id})
+}
+
+//Iter streams the values matching filter, see Cursor.Iter
+func (r *Repository[T]) Iter(filter Filter) *RepositoryIter[T] {
+	return &RepositoryIter[T]{it: r.driver.Cursor().Where(filter).Iter()}
+}
+
+//ForEach calls fn with every value matching filter, see Cursor.ForEach
+func (r *Repository[T]) ForEach(filter Filter, fn func(T) error) error {
+	return forEach(r.driver.Cursor().Where(filter).Iter(), func(doc Document) error {
+		var v T
+		if err := FromDocument(doc, &v); nil != err {
+			return err
+		}
+		return fn(v)
+	})
+}
+
+//RepositoryIter is the Iterator of a Repository, it decodes into a T
+type RepositoryIter[T any] struct {
+	it  Iterator
+	err error
+}
+
+//Next decodes the next value into v and reports whether there was one
+func (it *RepositoryIter[T]) Next(v *T) bool {
+	if nil != it.err {
+		return false
+	}
+	var doc Document
+	if !it.it.Next(&doc) {
+		return false
+	}
+	var value T
+	if it.err = FromDocument(doc, &value); nil != it.err {
+		return false
+	}
+	*v = value
+	return true
+}
+func (it *RepositoryIter[T]) Err() error {
+	if nil != it.err {
+		return it.err
+	}
+	return it.it.Err()
+}
+func (it *RepositoryIter[T]) Close() error {
+	if err := it.it.Close(); nil != err {
+		return err
+	}
+	return it.err
+}
@@ -1,6 +1,9 @@
 package storageDriver
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 type (
 	//Document is general data structure where keys are string and values are anything you want as long as the underlaying driver supports it
@@ -17,6 +20,16 @@ type Meta interface {
 	Clone() Meta
 	//Driver returns the actual driver which can be later queried
 	Driver() (StorageDriver, error)
+	//EnsureIndex creates an index on the given fields of the current table if it doesnt exist yet
+	EnsureIndex(fields ...string) error
+	//EnsureUniqueIndex is EnsureIndex rejecting writes that duplicate the indexed values with a *DuplicateKeyError
+	EnsureUniqueIndex(fields ...string) error
+	//Close releases the connection or files of the driver, neither the meta nor its StorageDriver can be used afterwards
+	Close() error
+	//Ping checks whether the backend is reachable before ctx is done
+	Ping(ctx context.Context) error
+	//Health pings the backend within HealthTimeout and reports latency, version and pool statistics
+	Health() HealthReport
 }
 type (
 	//Saver inserts or updates data
@@ -24,39 +37,94 @@ type (
 		Save(Query Document, Doc Document) error
 	}
 	// Getter Either returns a single doc (GetOne) or multiple (Get)
+	//Find and FindOne do the same for a driver agnostic Filter.
+	//No match is an empty slice for Get and Find but ErrNotFound for GetOne and FindOne
 	Getter interface {
 		Get(Query Document) ([]Document, error)
 		GetOne(Query Document) (Document, error)
+		Find(Query Filter) ([]Document, error)
+		FindOne(Query Filter) (Document, error)
 		Custom(Query interface{}) ([]Document, error)
 	}
-	//Updater updates the data and returns the updated document.
+	//Updater updates the data, FindAndUpdate also returns the document as it was before or after the change.
 	//If there are no documents to update returns an error
 	//UpdateMulti returns also updatedDocuments number
+	//UpdateWith, UpdateMultiWith and SaveWith change the documents with the operators of an Update instead of overwriting fields,
+	//SaveWith inserts the equality conditions of the query changed by the update when nothing matches
 	Updater interface {
 		Update(Query Document, UpdateFields Document) error
 		UpdateMulti(Query Document, UpdateFields Document) (int, error)
+		UpdateWith(Query Document, Change *Update) error
+		UpdateMultiWith(Query Document, Change *Update) (int, error)
+		SaveWith(Query Document, Change *Update) error
+		FindAndUpdate(Query Document, Change *Update, Options FindAndUpdateOptions) (Document, error)
 	}
 	//Inserter inserts the document and returns an error if cannot insert
 	//InsertMulti fails on the first error and returns the error stopping the execution
 	//On the other hand InsertMultiNoFail doesnt fail on error and returns a slice of errors occured during the execution
 	//Also you may pass an optional io.Writer to see the errors in realtime
+	//InsertWithID gives the document an ObjectId _id when it has none and returns the _id it was stored with
 	Inserter interface {
 		Insert(Doc Document) error
+		InsertWithID(Doc Document) (interface{}, error)
 		InsertMulti(Docs []Document) error
 		InsertMultiNoFail(Docs []Document, ErrorOut ...io.Writer) []error
 	}
 	// Remover removes the document and returns an error if cannot remove
+	//FindAndRemove also returns the removed document
+	//RemoveMulti removes every match and returns how many there were, no match is not an error
 	Remover interface {
 		Remove(Query Document) error
+		RemoveMulti(Query Document) (int, error)
+		FindAndRemove(Query Document) (Document, error)
+	}
+	//StructMapper stores and loads tagged structs instead of Documents, see ToDocument for the tags.
+	//InsertStruct, SaveStruct and UpdateStruct take a struct or a pointer to one and behave like Insert, Save and Update.
+	//GetInto fills a pointer to a slice and GetOneInto a pointer to a struct, they fail like Get and GetOne
+	StructMapper interface {
+		InsertStruct(Doc interface{}) error
+		SaveStruct(Query Document, Doc interface{}) error
+		UpdateStruct(Query Document, Doc interface{}) error
+		GetInto(Query Document, Out interface{}) error
+		GetOneInto(Query Document, Out interface{}) error
+	}
+	//StorageDriverContext mirrors Saver, Getter, Updater, Inserter, Remover and StructMapper with a context
+	//so a call can be cancelled or bound to a deadline.
+	//A write that returns ctx.Err() has an unknown outcome, mongodb may still apply it after the call returned
+	StorageDriverContext interface {
+		SaveCtx(ctx context.Context, Query Document, Doc Document) error
+		GetCtx(ctx context.Context, Query Document) ([]Document, error)
+		GetOneCtx(ctx context.Context, Query Document) (Document, error)
+		UpdateCtx(ctx context.Context, Query Document, UpdateFields Document) error
+		UpdateMultiCtx(ctx context.Context, Query Document, UpdateFields Document) (int, error)
+		InsertCtx(ctx context.Context, Doc Document) error
+		InsertWithIDCtx(ctx context.Context, Doc Document) (interface{}, error)
+		InsertMultiCtx(ctx context.Context, Docs []Document) error
+		InsertMultiNoFailCtx(ctx context.Context, Docs []Document, ErrorOut ...io.Writer) []error
+		RemoveCtx(ctx context.Context, Query Document) error
+		RemoveMultiCtx(ctx context.Context, Query Document) (int, error)
+		UpdateWithCtx(ctx context.Context, Query Document, Change *Update) error
+		UpdateMultiWithCtx(ctx context.Context, Query Document, Change *Update) (int, error)
+		SaveWithCtx(ctx context.Context, Query Document, Change *Update) error
+		FindAndUpdateCtx(ctx context.Context, Query Document, Change *Update, Options FindAndUpdateOptions) (Document, error)
+		FindAndRemoveCtx(ctx context.Context, Query Document) (Document, error)
+		InsertStructCtx(ctx context.Context, Doc interface{}) error
+		SaveStructCtx(ctx context.Context, Query Document, Doc interface{}) error
+		UpdateStructCtx(ctx context.Context, Query Document, Doc interface{}) error
+		GetIntoCtx(ctx context.Context, Query Document, Out interface{}) error
+		GetOneIntoCtx(ctx context.Context, Query Document, Out interface{}) error
 	}
 	StorageDriver interface {
+		StorageDriverContext
 		Saver
 		Getter
 		Updater
 		Inserter
 		Remover
+		StructMapper
 		AggregateMongo([]map[string]interface{}) ([]Document, error)
 		Cursor() Cursor
+		Bulk() BulkWriter
 		Lt(Doc Document) Document
 		Gt(Doc Document) Document
 		Gte(Doc Document) Document
@@ -67,8 +135,12 @@ type (
 		Regex(key string, value string) Document
 	}
 )
+
+//Cursor builds a query step by step. Cursors are immutable, every call returns a new Cursor and leaves the receiver as it was,
+//so a cursor can be run several times, extended in different ways and shared between goroutines
 type Cursor interface {
 	And(Doc Document) Cursor
+	Where(Query Filter) Cursor
 	Or([]interface{}) Cursor
 	Select(fieldNames ...string) Cursor
 	Sort(Doc ...string) Cursor
@@ -78,10 +150,27 @@ type Cursor interface {
 	All(Doc interface{}) error
 	Count(num *int) error
 	Distinct(key string, result interface{}) error
+	//Iter streams the documents instead of loading them all like All does
+	Iter() Iterator
+	//Batch sets how many documents Iter fetches per round trip, Prefetch how much of a batch is consumed before
+	//the next one is requested. Drivers without round trips ignore both
+	Batch(n int) Cursor
+	Prefetch(p float64) Cursor
+	//ForEach calls fn with every document, returning ErrStopIteration from fn stops early without an error
+	ForEach(fn func(Document) error) error
+}
+
+//Iterator is returned by Cursor.Iter. Next decodes the next document into doc and returns false at the end or on error,
+//Err tells which one it was. Close releases the resources of the iterator and must be called when it is dropped early
+type Iterator interface {
+	Next(doc interface{}) bool
+	Err() error
+	Close() error
 }
 type DummyCursor struct{}
 
 func (d DummyCursor) And(Doc Document) Cursor                       { return d }
+func (d DummyCursor) Where(Query Filter) Cursor                     { return d }
 func (d DummyCursor) Or([]interface{}) Cursor                       { return d }
 func (d DummyCursor) Select(fieldNames ...string) Cursor            { return d }
 func (d DummyCursor) Sort(Doc ...string) Cursor                     { return d }
@@ -91,3 +180,7 @@ func (d DummyCursor) Skip(num int) Cursor                           { return d }
 func (d DummyCursor) All(Doc interface{}) error                     { return nil }
 func (d DummyCursor) Count(num *int) error                          { return nil }
 func (d DummyCursor) Distinct(key string, result interface{}) error { return nil }
+func (d DummyCursor) Iter() Iterator                                { return errIterator{} }
+func (d DummyCursor) Batch(n int) Cursor                            { return d }
+func (d DummyCursor) Prefetch(p float64) Cursor                     { return d }
+func (d DummyCursor) ForEach(fn func(Document) error) error         { return nil }
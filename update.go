@@ -0,0 +1,159 @@
+package storageDriver
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Update describes a change made with update operators instead of overwriting fields, build it with NewUpdate.
+//Targeting a field with two different operators, or a field and one of its sub fields, is an error
+//reported by Document and by the drivers, like mongodb does
+type Update struct {
+	ops    Document
+	fields map[string]string
+	err    error
+}
+
+//FindAndUpdateOptions tunes FindAndUpdate. The document before the change is returned unless ReturnNew is set.
+//With Upsert a document is inserted when nothing matches, nil is returned for it then unless ReturnNew is set.
+//Sort picks the document when several match and Fields restricts the returned fields like Cursor.Select does
+type FindAndUpdateOptions struct {
+	ReturnNew bool
+	Upsert    bool
+	Sort      []string
+	Fields    []string
+}
+
+//NewUpdate returns an empty Update
+func NewUpdate() *Update {
+	return &Update{ops: Document{}, fields: make(map[string]string)}
+}
+
+//Set sets field to value
+func (u *Update) Set(field string, value interface{}) *Update {
+	return u.add("$set", field, value)
+}
+
+//Unset removes the fields
+func (u *Update) Unset(fields ...string) *Update {
+	for _, field := range fields {
+		u.add("$unset", field, "")
+	}
+	return u
+}
+
+//Inc adds by to field, a missing field is set to by
+func (u *Update) Inc(field string, by interface{}) *Update {
+	return u.add("$inc", field, by)
+}
+
+//Mul multiplies field by by, a missing field is set to 0
+func (u *Update) Mul(field string, by interface{}) *Update {
+	return u.add("$mul", field, by)
+}
+
+//Min sets field to value if value is less than the current one or the field is missing
+func (u *Update) Min(field string, value interface{}) *Update {
+	return u.add("$min", field, value)
+}
+
+//Max sets field to value if value is greater than the current one or the field is missing
+func (u *Update) Max(field string, value interface{}) *Update {
+	return u.add("$max", field, value)
+}
+
+//Push appends the values to the array field
+func (u *Update) Push(field string, values ...interface{}) *Update {
+	return u.addEach("$push", field, values)
+}
+
+//AddToSet appends the values the array field does not contain yet
+func (u *Update) AddToSet(field string, values ...interface{}) *Update {
+	return u.addEach("$addToSet", field, values)
+}
+
+//Pull removes the elements of the array field equal to value, value may also be a condition like Document{"$gt": 3}
+func (u *Update) Pull(field string, value interface{}) *Update {
+	return u.add("$pull", field, value)
+}
+
+//Rename moves the value of from to to
+func (u *Update) Rename(from, to string) *Update {
+	if nil == u.err && from == to {
+		u.err = fmt.Errorf("cannot rename %s to itself", from)
+	}
+	u.claim("$rename", to)
+	return u.add("$rename", from, to)
+}
+
+//CurrentDate sets the fields to the current time
+func (u *Update) CurrentDate(fields ...string) *Update {
+	for _, field := range fields {
+		u.add("$currentDate", field, true)
+	}
+	return u
+}
+
+//Document returns the update as mongodb update operators, a copy later calls on u do not change
+func (u *Update) Document() (Document, error) {
+	if nil == u {
+		return nil, fmt.Errorf("nil update")
+	}
+	if nil != u.err {
+		return nil, u.err
+	}
+	if len(u.ops) == 0 {
+		return nil, fmt.Errorf("empty update")
+	}
+	var doc = make(Document, len(u.ops))
+	for op, fields := range u.ops {
+		doc[op] = copyDocument(fields.(Document))
+	}
+	return doc, nil
+}
+
+func (u *Update) add(op, field string, value interface{}) *Update {
+	if !u.claim(op, field) {
+		return u
+	}
+	fields, ok := u.ops[op].(Document)
+	if !ok {
+		fields = Document{}
+		u.ops[op] = fields
+	}
+	fields[field] = value
+	return u
+}
+
+//addEach merges repeated calls on the same field into a single $each
+func (u *Update) addEach(op, field string, values []interface{}) *Update {
+	if fields, ok := u.ops[op].(Document); ok && u.fields[field] == op {
+		if each, ok := fields[field].(Document); ok {
+			each["$each"] = append(each["$each"].([]interface{}), values...)
+			return u
+		}
+	}
+	return u.add(op, field, Document{"$each": append([]interface{}(nil), values...)})
+}
+
+//claim records that op changes field, it fails when another operator already changes the field or a related one
+func (u *Update) claim(op, field string) bool {
+	if nil != u.err {
+		return false
+	}
+	if field == "" {
+		u.err = fmt.Errorf("%s on an empty field name", op)
+		return false
+	}
+	for other, otherOp := range u.fields {
+		if other == field && otherOp == op {
+			continue
+		}
+		if other == field || strings.HasPrefix(other, field+".") || strings.HasPrefix(field, other+".") {
+			u.err = fmt.Errorf("%s on %s conflicts with %s on %s", op, field, otherOp, other)
+			return false
+		}
+	}
+	u.fields[field] = op
+	return true
+}